@@ -4,4 +4,7 @@ const (
 	MediaTypeImageBtrfsLayer  = "application/vnd.cisco.image.layer.btrfs"
 	GitVersionAnnotation      = "com.cisco.stacker.git_version"
 	StackerContentsAnnotation = "com.cisco.stacker.stacker_yaml"
+	SourceDigestAnnotation    = "com.cisco.stacker.source_digest"
+	SignaturePolicyAnnotation = "com.cisco.stacker.signature_policy"
+	ConvertedLayerAnnotation  = "com.cisco.stacker.converted_layer"
 )
@@ -10,7 +10,10 @@ import (
 	"io/ioutil"
 	"net/http"
 	"os"
+	"os/exec"
 	"path"
+	"path/filepath"
+	"reflect"
 	"strings"
 	"syscall"
 	"time"
@@ -32,53 +35,79 @@ import (
 
 type Apply struct {
 	layers             []ispec.Descriptor
+	sfm                types.StackerFiles
 	opts               BaseLayerOpts
 	storage            types.Storage
 	considerTimestamps bool
+
+	// buildOnlyBase means the rootfs has changes from build-only layers
+	// that aren't in any OCI layer, so applied layers can't be added to
+	// the image as-is: we just merge their contents, and the layer's final
+	// repack picks them up along with the build-only layers' changes.
+	buildOnlyBase bool
+
+	// dryRun applies into a scratch snapshot instead of the layer's rootfs,
+	// and records conflicts in conflicts instead of failing.
+	dryRun    bool
+	conflicts []string
+	current   string
+}
+
+// applyConflict is a conflict between an applied file and the rootfs that the
+// layer's apply_policy didn't resolve, as opposed to e.g. an I/O error.
+type applyConflict struct {
+	msg string
+}
+
+func (c *applyConflict) Error() string {
+	return c.msg
 }
 
-func NewApply(sfm types.StackerFiles, opts BaseLayerOpts, storage types.Storage, considerTimestamps bool) (*Apply, error) {
-	a := &Apply{layers: []ispec.Descriptor{}, opts: opts, storage: storage}
+func conflictf(format string, args ...interface{}) error {
+	return &applyConflict{msg: fmt.Sprintf(format, args...)}
+}
+
+func NewApply(sfm types.StackerFiles, opts BaseLayerOpts, storage types.Storage, considerTimestamps bool, dryRun bool) (*Apply, error) {
+	a := &Apply{layers: []ispec.Descriptor{}, sfm: sfm, opts: opts, storage: storage, dryRun: dryRun}
 
 	if len(opts.Layer.Apply) == 0 {
 		return a, nil
 	}
 
+	// Build-only layers don't generate OCI layers, so the layers we
+	// already have are those of the first ancestor that isn't build-only
+	// (which is what copyBuiltTypeBaseToOutput put in our output).
+	from := opts.Layer.From
+	for from.Type == types.BuiltLayer {
+		base, ok := sfm.LookupLayerDefinition(from.Tag)
+		if !ok {
+			return nil, errors.Errorf("missing base layer: %s?", from.Tag)
+		}
+
+		if !base.BuildOnly {
+			break
+		}
+
+		a.buildOnlyBase = true
+		from = base.From
+	}
+
 	var source casext.Engine
 
-	if opts.Layer.From.Type == types.DockerLayer || opts.Layer.From.Type == types.OCILayer {
+	switch from.Type {
+	case types.DockerLayer, types.OCILayer, types.ContainersStorageLayer:
 		var err error
 		source, err = umoci.OpenLayout(path.Join(a.opts.Config.StackerDir, "layer-bases", "oci"))
 		if err != nil {
 			return nil, err
 		}
 		defer source.Close()
-	} else if opts.Layer.From.Type == types.BuiltLayer {
-		// Search for the base layer in all of the built stackerfiles
-		base, ok := sfm.LookupLayerDefinition(opts.Layer.From.Tag)
-		if !ok {
-			return nil, errors.Errorf("missing base layer: %s?", opts.Layer.From.Tag)
-		}
-
-		if base.BuildOnly {
-			// XXX: this isn't actually that hard to support if we
-			// need to, but I suspect we don't really. The problem
-			// is that no OCI layers are generated for build-only
-			// layers by design, so we can't compare which layers
-			// are already used. We're smart enough to handle this
-			// well, but it'll take a _lot_ longer, since we
-			// re-extract everything the build-only layer is based
-			// on. Anyway, let's warn people.
-			if len(opts.Layer.Apply) > 0 {
-				return nil, errors.Errorf("WARNING: build-only base layers with apply statements may be wonky")
-			}
-		} else {
-			source = opts.OCI
-		}
+	case types.BuiltLayer:
+		source = opts.OCI
 	}
 
 	if source.Engine != nil {
-		tag, err := opts.Layer.From.ParseTag()
+		tag, err := from.ParseTag()
 		if err != nil {
 			return nil, err
 		}
@@ -105,8 +134,17 @@ func (a *Apply) DoApply() error {
 	}
 	defer a.storage.Delete("stacker-apply-base")
 
+	if a.dryRun {
+		err = a.storage.Snapshot(a.opts.Name, "stacker-apply-dry-run")
+		if err != nil {
+			return err
+		}
+		defer a.storage.Delete("stacker-apply-dry-run")
+	}
+
 	for _, image := range a.opts.Layer.Apply {
 		log.Infof("merging in layers from %s", image)
+		a.current = image
 		err = a.applyImage(image)
 		if err != nil {
 			return err
@@ -116,57 +154,100 @@ func (a *Apply) DoApply() error {
 	return nil
 }
 
-func (a *Apply) applyImage(layer string) error {
-	is, err := types.NewImageSource(layer)
-	if err != nil {
-		return err
+// Conflicts returns the conflicts a dry run found.
+func (a *Apply) Conflicts() []string {
+	return a.conflicts
+}
+
+// target is the name of the rootfs that layers are applied to.
+func (a *Apply) target() string {
+	if a.dryRun {
+		return "stacker-apply-dry-run"
 	}
+	return a.opts.Name
+}
 
-	err = importContainersImage(is, a.opts.Config, a.opts.Progress)
-	if err != nil {
-		return err
+// recordConflict swallows conflicts during dry runs, remembering them so they
+// can all be reported at the end.
+func (a *Apply) recordConflict(err error) error {
+	if err == nil {
+		return nil
 	}
 
-	layerBases, err := umoci.OpenLayout(path.Join(a.opts.Config.StackerDir, "layer-bases", "oci"))
-	if err != nil {
+	if _, ok := errors.Cause(err).(*applyConflict); !ok || !a.dryRun {
 		return err
 	}
-	defer layerBases.Close()
 
-	tag, err := is.ParseTag()
+	conflict := fmt.Sprintf("%s: %v", a.current, err)
+	log.Infof("apply conflict: %s", conflict)
+	a.conflicts = append(a.conflicts, conflict)
+	return nil
+}
+
+func (a *Apply) applyImage(layer string) error {
+	is, err := types.NewImageSource(layer)
 	if err != nil {
 		return err
 	}
 
-	manifest, err := stackeroci.LookupManifest(layerBases, tag)
-	if err != nil {
-		return err
+	// layers built by this build are in our output; everything else gets
+	// pulled into the layer-bases cache.
+	var source casext.Engine
+	var sourceDir string
+
+	if is.Type == types.BuiltLayer {
+		applied, ok := a.sfm.LookupLayerDefinition(is.Tag)
+		if !ok {
+			return errors.Errorf("missing applied layer: %s?", is.Tag)
+		}
+
+		if applied.BuildOnly {
+			return errors.Errorf("can't apply build only layer %s, it has no OCI layers", is.Tag)
+		}
+
+		source = a.opts.OCI
+		sourceDir = a.opts.Config.OCIDir
+	} else {
+		locked, err := a.opts.Lock.lockedDigest(is)
+		if err != nil {
+			return err
+		}
+
+		err = importContainersImage(is, a.opts.Config, a.opts.PullPolicy, a.opts.Progress, locked)
+		if err != nil {
+			return err
+		}
+
+		if err := a.opts.Lock.checkImage(a.opts.Config, is); err != nil {
+			return err
+		}
+
+		sourceDir = path.Join(a.opts.Config.StackerDir, "layer-bases", "oci")
+		source, err = umoci.OpenLayout(sourceDir)
+		if err != nil {
+			return err
+		}
+		defer source.Close()
 	}
 
-	config, err := stackeroci.LookupConfig(layerBases, manifest.Config)
+	tag, err := is.ParseTag()
 	if err != nil {
 		return err
 	}
 
-	baseTag, err := a.opts.Layer.From.ParseTag()
+	manifest, err := stackeroci.LookupManifest(source, tag)
 	if err != nil {
 		return err
 	}
 
-	baseManifest, err := stackeroci.LookupManifest(a.opts.OCI, a.opts.Name)
+	config, err := stackeroci.LookupConfig(source, manifest.Config)
 	if err != nil {
-		baseManifest, err = stackeroci.LookupManifest(layerBases, baseTag)
-		if err != nil {
-			return err
-		}
+		return err
 	}
 
-	baseConfig, err := stackeroci.LookupConfig(a.opts.OCI, baseManifest.Config)
+	baseManifest, baseConfig, err := a.baseImage()
 	if err != nil {
-		baseConfig, err = stackeroci.LookupConfig(layerBases, baseManifest.Config)
-		if err != nil {
-			return err
-		}
+		return err
 	}
 
 	for i, l := range manifest.Layers {
@@ -189,13 +270,17 @@ func (a *Apply) applyImage(layer string) error {
 		// layer is strictly additive or doesn't otherwise require
 		// merging, we could realize that and add it directly to the
 		// OCI output, so that it is kept as its own layer.
-		err := a.applyLayer(layerBases, l, path.Join(a.opts.Config.RootFSDir, a.opts.Name))
+		err := a.applyLayer(source, sourceDir, l, path.Join(a.opts.Config.RootFSDir, a.target()))
 		if err != nil {
 			return err
 		}
 
 		a.layers = append(a.layers, l)
 
+		if a.dryRun || a.buildOnlyBase {
+			continue
+		}
+
 		// Let's be slightly intelligent here: we can share exactly the layers,
 		// since either 1. it is identical because we didn't do any merges, or
 		// 2. there is a tiny delta, which we will generate in the final build
@@ -207,7 +292,7 @@ func (a *Apply) applyImage(layer string) error {
 		// want to uncompress the blob just to decompress it again. We could
 		// restructure this so we only have to read the blob once, though.
 		if _, err := a.opts.OCI.FromDescriptor(context.Background(), l); err != nil {
-			blob, err := layerBases.FromDescriptor(context.Background(), l)
+			blob, err := source.FromDescriptor(context.Background(), l)
 			if err != nil {
 				return errors.Wrapf(err, "huh? found layer before but not second time")
 			}
@@ -235,6 +320,15 @@ func (a *Apply) applyImage(layer string) error {
 		baseConfig.RootFS.DiffIDs = append(baseConfig.RootFS.DiffIDs, config.RootFS.DiffIDs[i])
 	}
 
+	err = a.mergeConfig(layer, &baseConfig, config)
+	if err := a.recordConflict(err); err != nil {
+		return err
+	}
+
+	if a.dryRun {
+		return nil
+	}
+
 	// Add the layer to the image.
 	digest, size, err := a.opts.OCI.PutBlobJSON(context.Background(), baseConfig)
 	if err != nil {
@@ -266,13 +360,29 @@ func (a *Apply) applyImage(layer string) error {
 	newMtreeName := strings.Replace(manifestDesc.Digest.String(), ":", "_", 1)
 	bundlePath := path.Join(a.opts.Config.RootFSDir, a.opts.Name)
 
-	// Remove the mtree file if it exists: GenerateBundleManifest() fails
-	// if it already exists, and it may exist because we restored from a
-	// previous snapshot.
-	os.RemoveAll(path.Join(bundlePath, newMtreeName+".mtree"))
-	err = umoci.GenerateBundleManifest(newMtreeName, bundlePath, fseval.Rootless)
-	if err != nil {
-		return err
+	if a.buildOnlyBase {
+		// We didn't add any layers, only (maybe) config, so the old
+		// mtree still describes the image; keep it, so that the final
+		// repack picks up everything that isn't in the image yet.
+		meta, err := umoci.ReadBundleMeta(bundlePath)
+		if err != nil {
+			return err
+		}
+
+		oldMtreeName := strings.Replace(meta.From.Descriptor().Digest.String(), ":", "_", 1)
+		err = os.Rename(path.Join(bundlePath, oldMtreeName+".mtree"), path.Join(bundlePath, newMtreeName+".mtree"))
+		if err != nil {
+			return errors.Wrapf(err, "couldn't rename mtree")
+		}
+	} else {
+		// Remove the mtree file if it exists: GenerateBundleManifest()
+		// fails if it already exists, and it may exist because we
+		// restored from a previous snapshot.
+		os.RemoveAll(path.Join(bundlePath, newMtreeName+".mtree"))
+		err = umoci.GenerateBundleManifest(newMtreeName, bundlePath, fseval.Rootless)
+		if err != nil {
+			return err
+		}
 	}
 
 	// Update umoci's metadata.
@@ -288,6 +398,178 @@ func (a *Apply) applyImage(layer string) error {
 	return nil
 }
 
+// baseImage returns the manifest and config of the image being applied onto:
+// our output, if it has been copied there yet, or else the cached base.
+func (a *Apply) baseImage() (ispec.Manifest, ispec.Image, error) {
+	manifest, err := stackeroci.LookupManifest(a.opts.OCI, a.opts.Name)
+	if err == nil {
+		config, err := stackeroci.LookupConfig(a.opts.OCI, manifest.Config)
+		return manifest, config, err
+	}
+
+	layerBases, err := umoci.OpenLayout(path.Join(a.opts.Config.StackerDir, "layer-bases", "oci"))
+	if err != nil {
+		return ispec.Manifest{}, ispec.Image{}, err
+	}
+	defer layerBases.Close()
+
+	baseTag, err := a.opts.Layer.From.ParseTag()
+	if err != nil {
+		return ispec.Manifest{}, ispec.Image{}, err
+	}
+
+	manifest, err = stackeroci.LookupManifest(layerBases, baseTag)
+	if err != nil {
+		return ispec.Manifest{}, ispec.Image{}, err
+	}
+
+	config, err := stackeroci.LookupConfig(layerBases, manifest.Config)
+	return manifest, config, err
+}
+
+// mergeConfig folds the parts of the applied image's config selected by the
+// layer's apply_config into baseConfig, recording where they came from in its
+// history. Values that differ from what's already there are conflicts, unless
+// the layer sets them itself (since the layer's settings are applied last).
+func (a *Apply) mergeConfig(image string, baseConfig *ispec.Image, applied ispec.Image) error {
+	mode, err := a.opts.Layer.ParseApplyConfig()
+	if err != nil {
+		return err
+	}
+
+	if mode == types.ApplyConfigNone {
+		return nil
+	}
+
+	merged := []string{}
+	base := &baseConfig.Config
+
+	if mode == types.ApplyConfigEnv || mode == types.ApplyConfigAll {
+		changed := false
+		for _, kv := range applied.Config.Env {
+			k := strings.SplitN(kv, "=", 2)[0]
+
+			found := false
+			for i, existing := range base.Env {
+				if strings.SplitN(existing, "=", 2)[0] != k {
+					continue
+				}
+
+				found = true
+				if existing == kv {
+					break
+				}
+
+				if _, ok := a.opts.Layer.Environment[k]; !ok {
+					return conflictf("apply_config: %s sets %s, but it is already %s", image, kv, existing)
+				}
+
+				base.Env[i] = kv
+				changed = true
+				break
+			}
+
+			if !found {
+				base.Env = append(base.Env, kv)
+				changed = true
+			}
+		}
+
+		if changed {
+			merged = append(merged, "env")
+		}
+	}
+
+	if mode == types.ApplyConfigLabels || mode == types.ApplyConfigAll {
+		changed := false
+		for k, v := range applied.Config.Labels {
+			existing, ok := base.Labels[k]
+			if ok && existing == v {
+				continue
+			}
+
+			if _, override := a.opts.Layer.Labels[k]; ok && !override {
+				return conflictf("apply_config: %s sets label %s=%s, but it is already %s", image, k, v, existing)
+			}
+
+			if base.Labels == nil {
+				base.Labels = map[string]string{}
+			}
+			base.Labels[k] = v
+			changed = true
+		}
+
+		if changed {
+			merged = append(merged, "labels")
+		}
+	}
+
+	if mode == types.ApplyConfigAll {
+		changed := false
+		for port := range applied.Config.ExposedPorts {
+			if _, ok := base.ExposedPorts[port]; ok {
+				continue
+			}
+
+			if base.ExposedPorts == nil {
+				base.ExposedPorts = map[string]struct{}{}
+			}
+			base.ExposedPorts[port] = struct{}{}
+			changed = true
+		}
+
+		if changed {
+			merged = append(merged, "exposed ports")
+		}
+
+		changed = false
+		for volume := range applied.Config.Volumes {
+			if _, ok := base.Volumes[volume]; ok {
+				continue
+			}
+
+			if base.Volumes == nil {
+				base.Volumes = map[string]struct{}{}
+			}
+			base.Volumes[volume] = struct{}{}
+			changed = true
+		}
+
+		if changed {
+			merged = append(merged, "volumes")
+		}
+
+		if len(applied.Config.Entrypoint) > 0 || len(applied.Config.Cmd) > 0 {
+			same := reflect.DeepEqual(base.Entrypoint, applied.Config.Entrypoint) && reflect.DeepEqual(base.Cmd, applied.Config.Cmd)
+			unset := len(base.Entrypoint) == 0 && len(base.Cmd) == 0
+			override := a.opts.Layer.Entrypoint != nil || a.opts.Layer.Cmd != nil || a.opts.Layer.FullCommand != nil
+			if !same && !unset && !override {
+				return conflictf("apply_config: %s sets entrypoint %v and cmd %v, but they are already %v and %v", image, applied.Config.Entrypoint, applied.Config.Cmd, base.Entrypoint, base.Cmd)
+			}
+
+			if !same {
+				base.Entrypoint = applied.Config.Entrypoint
+				base.Cmd = applied.Config.Cmd
+				merged = append(merged, "entrypoint")
+			}
+		}
+	}
+
+	if len(merged) == 0 {
+		return nil
+	}
+
+	now := time.Now()
+	baseConfig.History = append(baseConfig.History, ispec.History{
+		Created:    &now,
+		CreatedBy:  "stacker apply_config",
+		Comment:    fmt.Sprintf("merged %s from %s", strings.Join(merged, ", "), image),
+		EmptyLayer: true,
+	})
+
+	return nil
+}
+
 func getReader(blob *casext.Blob) (io.ReadCloser, bool, error) {
 	var reader io.ReadCloser
 	var err error
@@ -303,6 +585,9 @@ func getReader(blob *casext.Blob) (io.ReadCloser, bool, error) {
 			return nil, false, err
 		}
 		needsClose = true
+	case stackeroci.MediaTypeLayerSquashfs:
+		// squashfs layers aren't compressed, so the blob is the layer
+		reader = blob.Data.(io.ReadCloser)
 	default:
 		return nil, false, errors.Errorf("unknown layer type %s", blob.Descriptor.MediaType)
 	}
@@ -310,7 +595,11 @@ func getReader(blob *casext.Blob) (io.ReadCloser, bool, error) {
 	return reader, needsClose, nil
 }
 
-func (a *Apply) applyLayer(cacheOCI casext.Engine, desc ispec.Descriptor, target string) error {
+func (a *Apply) applyLayer(cacheOCI casext.Engine, cacheDir string, desc ispec.Descriptor, target string) error {
+	if desc.MediaType == stackeroci.MediaTypeLayerSquashfs {
+		return a.applySquashfsLayer(cacheDir, desc, target)
+	}
+
 	blob, err := cacheOCI.FromDescriptor(context.Background(), desc)
 	if err != nil {
 		return err
@@ -348,7 +637,7 @@ func (a *Apply) applyLayer(cacheOCI casext.Engine, desc ispec.Descriptor, target
 		}
 
 		merged, err := a.insertOneFile(hdr, path.Join(target, "rootfs"), te, tr)
-		if err != nil {
+		if err := a.recordConflict(err); err != nil {
 			return err
 		}
 
@@ -358,6 +647,151 @@ func (a *Apply) applyLayer(cacheOCI casext.Engine, desc ispec.Descriptor, target
 	return nil
 }
 
+// applySquashfsLayer merges the squashfs layer desc into target. Since there's
+// no library for reading squashfs images, we unsquashfs it next to the rootfs,
+// and then feed each file through insertOneFile() as if it came from a tar
+// layer, so squashfs layers get the same conflict checking as tar ones.
+func (a *Apply) applySquashfsLayer(cacheDir string, desc ispec.Descriptor, target string) error {
+	blobPath := path.Join(cacheDir, "blobs", desc.Digest.Algorithm().String(), desc.Digest.Encoded())
+
+	dir, err := ioutil.TempDir(a.opts.Config.RootFSDir, "stacker-apply-squashfs-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+
+	// unsquashfs wants to create the directory itself
+	extracted := path.Join(dir, "rootfs")
+	output, err := exec.Command("unsquashfs", "-f", "-d", extracted, blobPath).CombinedOutput()
+	if err != nil {
+		return errors.Wrapf(err, "couldn't unsquashfs %s: %s", desc.Digest, string(output))
+	}
+
+	te := layer.NewTarExtractor(layer.UnpackOptions{})
+	links := map[uint64]string{}
+	return filepath.Walk(extracted, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		name, err := filepath.Rel(extracted, p)
+		if err != nil {
+			return err
+		}
+
+		// as with tar layers, skip the root directory
+		if name == "." {
+			return nil
+		}
+
+		hdr, err := squashfsEntryHeader(p, name, info, links)
+		if err != nil {
+			return err
+		}
+
+		return a.applySquashfsEntry(hdr, p, target, te)
+	})
+}
+
+// applySquashfsEntry merges the extracted squashfs file at p, described by
+// hdr, into target.
+func (a *Apply) applySquashfsEntry(hdr *tar.Header, p string, target string, te *layer.TarExtractor) error {
+	var content io.Reader = &bytes.Buffer{}
+	if hdr.Typeflag == tar.TypeReg && hdr.Size > 0 {
+		f, err := os.Open(p)
+		if err != nil {
+			return errors.Wrapf(err, "couldn't open %s", hdr.Name)
+		}
+		defer f.Close()
+		content = f
+	}
+
+	_, err := a.insertOneFile(hdr, path.Join(target, "rootfs"), te, content)
+	return a.recordConflict(err)
+}
+
+// squashfsEntryHeader builds the tar header that a tar layer would have
+// contained for the file at p. Overlay-style whiteouts (0/0 char devices) are
+// translated to the OCI .wh. files tar layers use; .wh. files (which
+// GenerateSquashfsLayer writes when it can't mknod) already are. links tracks
+// the inodes seen so far, so hard links are rendered as tar hard links.
+func squashfsEntryHeader(p string, name string, info os.FileInfo, links map[uint64]string) (*tar.Header, error) {
+	st := info.Sys().(*syscall.Stat_t)
+
+	if info.Mode()&os.ModeCharDevice != 0 && st.Rdev == 0 {
+		return &tar.Header{
+			Name:     path.Join(path.Dir(name), ".wh."+path.Base(name)),
+			Typeflag: tar.TypeReg,
+			Mode:     0644,
+		}, nil
+	}
+
+	linkname := ""
+	if info.Mode()&os.ModeSymlink != 0 {
+		var err error
+		linkname, err = os.Readlink(p)
+		if err != nil {
+			return nil, errors.Wrapf(err, "couldn't readlink %s", name)
+		}
+	}
+
+	hdr, err := tar.FileInfoHeader(info, linkname)
+	if err != nil {
+		return nil, errors.Wrapf(err, "couldn't build header for %s", name)
+	}
+
+	hdr.Name = name
+	if info.IsDir() {
+		hdr.Name += "/"
+	}
+
+	// unsquashfs doesn't (can't) preserve these, so let's not compare
+	// them against the rootfs.
+	hdr.AccessTime = time.Time{}
+	hdr.ChangeTime = time.Time{}
+
+	if info.Mode().IsRegular() && st.Nlink > 1 {
+		if first, ok := links[st.Ino]; ok {
+			hdr.Typeflag = tar.TypeLink
+			hdr.Linkname = first
+			hdr.Size = 0
+		} else {
+			links[st.Ino] = name
+		}
+	}
+
+	sz, err := unix.Llistxattr(p, nil)
+	if err != nil && err != unix.ENOTSUP {
+		return nil, errors.Wrapf(err, "couldn't list xattrs for %s", name)
+	}
+
+	if sz > 0 {
+		buf := make([]byte, sz)
+		sz, err = unix.Llistxattr(p, buf)
+		if err != nil {
+			return nil, errors.Wrapf(err, "couldn't list xattrs for %s", name)
+		}
+
+		hdr.Xattrs = map[string]string{}
+		for _, xattr := range strings.Split(strings.TrimRight(string(buf[:sz]), "\x00"), "\x00") {
+			vsz, err := unix.Lgetxattr(p, xattr, nil)
+			if err != nil {
+				return nil, errors.Wrapf(err, "couldn't get xattr %s for %s", xattr, name)
+			}
+
+			value := make([]byte, vsz)
+			vsz, err = unix.Lgetxattr(p, xattr, value)
+			if err != nil {
+				return nil, errors.Wrapf(err, "couldn't get xattr %s for %s", xattr, name)
+			}
+
+			hdr.Xattrs[xattr] = string(value[:vsz])
+		}
+	}
+
+	return hdr, nil
+}
+
 func (a *Apply) insertOneFile(hdr *tar.Header, target string, te *layer.TarExtractor, tr io.Reader) (bool, error) {
 	fi, err := os.Lstat(path.Join(target, hdr.Name))
 	if os.IsNotExist(err) {
@@ -369,7 +803,7 @@ func (a *Apply) insertOneFile(hdr *tar.Header, target string, te *layer.TarExtra
 	}
 
 	if fi.Mode() != hdr.FileInfo().Mode() {
-		return false, errors.Errorf("apply can't merge files of different types: %s", hdr.Name)
+		return a.conflict(hdr, target, te, tr, "apply can't merge files of different types: %s", hdr.Name)
 	}
 
 	sysStat := fi.Sys().(*syscall.Stat_t)
@@ -394,23 +828,23 @@ func (a *Apply) insertOneFile(hdr *tar.Header, target string, te *layer.TarExtra
 				return false, nil
 			}
 
-			return false, errors.Errorf("two different mod times on %s %v %v", hdr.Name, fi.ModTime(), hdr.ModTime)
+			return a.conflict(hdr, target, te, tr, "two different mod times on %s %v %v", hdr.Name, fi.ModTime(), hdr.ModTime)
 		}
 
 		// explicitly don't consider access time
 		cSec, cNsec := sysStat.Ctim.Unix()
 		ctime := time.Unix(cSec, cNsec)
 		if ctime != hdr.ChangeTime && !hdr.ChangeTime.IsZero() {
-			return false, errors.Errorf("changed times differ on %s", hdr.Name)
+			return a.conflict(hdr, target, te, tr, "changed times differ on %s", hdr.Name)
 		}
 	}
 
 	if sysStat.Uid != uint32(hdr.Uid) {
-		return false, errors.Errorf("two different uids on %s: %v %v", hdr.Name, sysStat.Uid, hdr.Uid)
+		return a.conflict(hdr, target, te, tr, "two different uids on %s: %v %v", hdr.Name, sysStat.Uid, hdr.Uid)
 	}
 
 	if sysStat.Gid != uint32(hdr.Gid) {
-		return false, errors.Errorf("two different gids on %s: %v %v", hdr.Name, sysStat.Gid, hdr.Gid)
+		return a.conflict(hdr, target, te, tr, "two different gids on %s: %v %v", hdr.Name, sysStat.Gid, hdr.Gid)
 	}
 
 	sz, err := unix.Llistxattr(path.Join(target, hdr.Name), nil)
@@ -431,7 +865,7 @@ func (a *Apply) insertOneFile(hdr *tar.Header, target string, te *layer.TarExtra
 		}
 
 		if len(xattrs) != len(hdr.Xattrs) {
-			return false, errors.Errorf("different xattrs for %s: %v %v", hdr.Name, xattrs, hdr.Xattrs)
+			return a.conflict(hdr, target, te, tr, "different xattrs for %s: %v %v", hdr.Name, xattrs, hdr.Xattrs)
 		}
 
 		for k, v := range hdr.Xattrs {
@@ -444,7 +878,7 @@ func (a *Apply) insertOneFile(hdr *tar.Header, target string, te *layer.TarExtra
 			}
 
 			if !found {
-				return false, errors.Errorf("different xattrs for %s, missing %s=%s", hdr.Name, k, v)
+				return a.conflict(hdr, target, te, tr, "different xattrs for %s, missing %s=%s", hdr.Name, k, v)
 			}
 		}
 
@@ -459,12 +893,12 @@ func (a *Apply) insertOneFile(hdr *tar.Header, target string, te *layer.TarExtra
 	case tar.TypeChar, tar.TypeBlock:
 		if (hdr.FileInfo().Mode()&os.ModeCharDevice != 0) != (hdr.Typeflag == tar.TypeChar) {
 			if uint32(hdr.Devmajor) != unix.Major(sysStat.Dev) || uint32(hdr.Devminor) != unix.Minor(sysStat.Dev) {
-				return false, errors.Errorf("device number mismatches for %s", hdr.Name)
+				return a.conflict(hdr, target, te, tr, "device number mismatches for %s", hdr.Name)
 			}
 			return false, nil
 		}
 
-		return false, errors.Errorf("block/char mismatch: %s", hdr.Name)
+		return a.conflict(hdr, target, te, tr, "block/char mismatch: %s", hdr.Name)
 	case tar.TypeLink:
 		// make sure this new hard link points to the same
 		// place as the existing one.
@@ -476,7 +910,7 @@ func (a *Apply) insertOneFile(hdr *tar.Header, target string, te *layer.TarExtra
 		targetIno := targetFI.Sys().(*syscall.Stat_t).Ino
 		curIno := fi.Sys().(*syscall.Stat_t).Ino
 		if targetIno != curIno {
-			return false, errors.Errorf("hard link %s would change location", hdr.Name)
+			return a.conflict(hdr, target, te, tr, "hard link %s would change location", hdr.Name)
 		}
 
 		return false, nil
@@ -489,7 +923,7 @@ func (a *Apply) insertOneFile(hdr *tar.Header, target string, te *layer.TarExtra
 		}
 
 		if linkname != hdr.Linkname {
-			return false, errors.Errorf("%s would change symlink from %s to %s", hdr.Name, linkname, hdr.Linkname)
+			return a.conflict(hdr, target, te, tr, "%s would change symlink from %s to %s", hdr.Name, linkname, hdr.Linkname)
 		}
 
 		return false, nil
@@ -546,9 +980,28 @@ func (a *Apply) insertOneFile(hdr *tar.Header, target string, te *layer.TarExtra
 			}
 		}
 
-		// Now we know the files aren't equal. We don't want to
-		// try that hard to diff things, so let's make sure we
-		// only diff text files.
+		// Now we know the files aren't equal, so it's up to the
+		// apply_policy what to do.
+		policy, err := a.opts.Layer.ApplyPolicyFor(hdr.Name)
+		if err != nil {
+			return false, err
+		}
+
+		switch policy {
+		case types.ApplyPreferBase:
+			return false, nil
+		case types.ApplyPreferApplied:
+			content, err := ioutil.ReadFile(f.Name())
+			if err != nil {
+				return false, err
+			}
+			return true, overwriteFile(path.Join(target, hdr.Name), string(content))
+		case types.ApplyFail:
+			return false, conflictf("%s differs from the existing file", hdr.Name)
+		}
+
+		// We don't want to try that hard to diff things, so let's
+		// make sure we only diff text files.
 		buf := make([]byte, 512)
 		sz, err = existing.Read(buf)
 		if err != nil {
@@ -562,18 +1015,76 @@ func (a *Apply) insertOneFile(hdr *tar.Header, target string, te *layer.TarExtra
 
 		contentType := http.DetectContentType(buf[:sz])
 		if !strings.HasPrefix(contentType, "text") {
-			return false, errors.Errorf("existing file different, can't diff %s of type %s", hdr.Name, contentType)
+			return false, conflictf("existing file different, can't diff %s of type %s", hdr.Name, contentType)
 		}
 
 		// TODO: we've mutated the mtime of the directory, we should
 		// probably restore it (future applies are unlikely to work if
 		// we don't).
+		if policy == types.ApplyUnionLines {
+			return true, a.unionLines(hdr, f.Name())
+		}
 		return true, a.diffFile(hdr, f.Name())
 	default:
 		return false, errors.Errorf("unknown tar typeflag for %s", hdr.Name)
 	}
 }
 
+// conflict resolves a conflict between hdr and the existing file in target
+// according to the layer's apply_policy: the applied file either replaces the
+// existing one or is dropped, or the conflict described by format and args is
+// returned.
+func (a *Apply) conflict(hdr *tar.Header, target string, te *layer.TarExtractor, tr io.Reader, format string, args ...interface{}) (bool, error) {
+	policy, err := a.opts.Layer.ApplyPolicyFor(hdr.Name)
+	if err != nil {
+		return false, err
+	}
+
+	switch policy {
+	case types.ApplyPreferApplied:
+		return false, errors.Wrapf(te.UnpackEntry(target, hdr, tr), "unpacking %s", hdr.Name)
+	case types.ApplyPreferBase:
+		return false, nil
+	default:
+		return false, conflictf(format, args...)
+	}
+}
+
+// unionLines appends the lines of the file "temp" that aren't already in the
+// file referred to by hdr to it.
+func (a *Apply) unionLines(hdr *tar.Header, temp string) error {
+	file := path.Join(a.opts.Config.RootFSDir, a.target(), "rootfs", hdr.Name)
+	existing, err := ioutil.ReadFile(file)
+	if err != nil {
+		return errors.Wrapf(err, "couldn't read %s", file)
+	}
+
+	applied, err := ioutil.ReadFile(temp)
+	if err != nil {
+		return err
+	}
+
+	result := string(existing)
+	seen := map[string]bool{}
+	for _, line := range strings.Split(result, "\n") {
+		seen[line] = true
+	}
+
+	for _, line := range strings.Split(strings.TrimSuffix(string(applied), "\n"), "\n") {
+		if seen[line] {
+			continue
+		}
+
+		if result != "" && !strings.HasSuffix(result, "\n") {
+			result += "\n"
+		}
+		result += line + "\n"
+		seen[line] = true
+	}
+
+	return overwriteFile(file, result)
+}
+
 // diffFile diffs the file "temp" with the file in the original snapshot
 // referred to by hdr. It returns an error if there are conflicts with a
 // previous layer change, or nil if there is not. diffFile has applied the diff
@@ -587,7 +1098,7 @@ func (a *Apply) diffFile(hdr *tar.Header, temp string) error {
 
 	// now, apply it on top of all the other layer deltas. if it works,
 	// great, if not, we bail.
-	return applyPatch(path.Join(a.opts.Config.RootFSDir, a.opts.Name, "rootfs", hdr.Name), p)
+	return applyPatch(path.Join(a.opts.Config.RootFSDir, a.target(), "rootfs", hdr.Name), p)
 }
 
 func genPatch(p1 string, p2 string) ([]diffmatchpatch.Patch, error) {
@@ -627,10 +1138,14 @@ func applyPatch(file string, patch []diffmatchpatch.Patch) error {
 	result, applied := diffmatchpatch.New().PatchApply(patch, string(content))
 	for i, app := range applied {
 		if !app {
-			return errors.Errorf("couldn't merge %s, specifically hunk:\n%s", file, patch[i].String())
+			return conflictf("couldn't merge %s, specifically hunk:\n%s", file, patch[i].String())
 		}
 	}
 
+	return overwriteFile(file, result)
+}
+
+func overwriteFile(file string, result string) error {
 	// let's open it and truncate rather than create a new one, so we keep
 	// mode/xattrs, etc.
 	f, err := os.OpenFile(file, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0755)
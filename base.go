@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"io"
 	"os"
+	"os/exec"
 	"path"
 	"time"
 
@@ -14,6 +15,7 @@ import (
 	stackeroci "github.com/anuvu/stacker/oci"
 	"github.com/anuvu/stacker/squashfs"
 	"github.com/anuvu/stacker/types"
+	"github.com/containers/image/v5/pkg/compression"
 	"github.com/klauspost/pgzip"
 	"github.com/opencontainers/go-digest"
 	ispec "github.com/opencontainers/image-spec/specs-go/v1"
@@ -24,14 +26,16 @@ import (
 )
 
 type BaseLayerOpts struct {
-	Config    types.StackerConfig
-	Name      string
-	Layer     *types.Layer
-	Cache     *BuildCache
-	OCI       casext.Engine
-	LayerType string
-	Storage   types.Storage
-	Progress  bool
+	Config     types.StackerConfig
+	Name       string
+	Layer      *types.Layer
+	Cache      *BuildCache
+	OCI        casext.Engine
+	LayerType  string
+	Storage    types.Storage
+	Progress   bool
+	PullPolicy string
+	Lock       *lockChecker
 }
 
 // GetBase grabs the base layer and puts it in the cache.
@@ -47,13 +51,55 @@ func GetBase(o BaseLayerOpts) error {
 			return err
 		}
 
-		_, err := acquireUrl(o.Config, o.Layer.From.Url, cacheDir, o.Progress)
-		return err
+		tar, err := acquireUrl(o.Config, o.Layer.From.Url, cacheDir, o.Progress)
+		if err != nil {
+			return err
+		}
+
+		return o.Lock.checkImport(o.Layer.From.Url, tar)
+	case types.SquashfsLayer:
+		cacheDir := path.Join(o.Config.StackerDir, "layer-bases")
+		if err := os.MkdirAll(cacheDir, 0755); err != nil {
+			return err
+		}
+
+		image, err := acquireUrl(o.Config, o.Layer.From.Url, cacheDir, o.Progress)
+		if err != nil {
+			return err
+		}
+
+		return o.Lock.checkImport(o.Layer.From.Url, image)
+	case types.DirLayer:
+		dir, err := o.Layer.ParseDirBase()
+		if err != nil {
+			return err
+		}
+
+		st, err := os.Stat(dir)
+		if err != nil {
+			return errors.Wrapf(err, "couldn't find base dir")
+		}
+
+		if !st.IsDir() {
+			return errors.Errorf("%s is not a directory", dir)
+		}
+
+		return nil
 	/* now we can do all the containers/image types */
-	case types.OCILayer:
+	case types.OCILayer, types.ContainersStorageLayer:
 		fallthrough
 	case types.DockerLayer:
-		return importContainersImage(o.Layer.From, o.Config, o.Progress)
+		locked, err := o.Lock.lockedDigest(o.Layer.From)
+		if err != nil {
+			return err
+		}
+
+		err = importContainersImage(o.Layer.From, o.Config, o.PullPolicy, o.Progress, locked)
+		if err != nil {
+			return err
+		}
+
+		return o.Lock.checkImage(o.Config, o.Layer.From)
 	default:
 		return errors.Errorf("unknown layer type: %v", o.Layer.From.Type)
 	}
@@ -110,6 +156,28 @@ func SetupRootfs(o BaseLayerOpts, sfm types.StackerFiles) error {
 			return err
 		}
 		return setupTarRootfs(o)
+	case types.SquashfsLayer:
+		err := umociInit(o)
+		if err != nil {
+			return err
+		}
+
+		err = o.Storage.SetupEmptyRootfs(o.Name)
+		if err != nil {
+			return err
+		}
+		return setupSquashfsRootfs(o)
+	case types.DirLayer:
+		err := umociInit(o)
+		if err != nil {
+			return err
+		}
+
+		err = o.Storage.SetupEmptyRootfs(o.Name)
+		if err != nil {
+			return err
+		}
+		return setupDirRootfs(o)
 	case types.ScratchLayer:
 		err := umociInit(o)
 		if err != nil {
@@ -117,7 +185,7 @@ func SetupRootfs(o BaseLayerOpts, sfm types.StackerFiles) error {
 		}
 
 		return o.Storage.SetupEmptyRootfs(o.Name)
-	case types.OCILayer:
+	case types.OCILayer, types.ContainersStorageLayer:
 		fallthrough
 	case types.DockerLayer:
 		return setupContainersImageRootfs(o)
@@ -126,17 +194,121 @@ func SetupRootfs(o BaseLayerOpts, sfm types.StackerFiles) error {
 	}
 }
 
-func importContainersImage(is *types.ImageSource, config types.StackerConfig, progress bool) error {
+// effectivePullPolicy returns the pull policy that should be used for is:
+// --offline trumps everything (except for local images, which don't need the
+// network), then a pull policy specified in the image source itself, then the
+// one from the command line.
+func effectivePullPolicy(is *types.ImageSource, config types.StackerConfig, pullPolicy string) string {
+	if config.Offline && !isLocalImage(is) {
+		return types.PullNever
+	}
+
+	if is.Pull != "" {
+		return is.Pull
+	}
+
+	if pullPolicy == "" {
+		return types.PullAlways
+	}
+
+	return pullPolicy
+}
+
+// pullDigest returns the digest is should be pulled by: the one it is pinned
+// to, or else the one it is locked to (if any), or "" to pull it by tag.
+func pullDigest(is *types.ImageSource, locked digest.Digest) (digest.Digest, error) {
+	pinned, err := is.PinnedDigest()
+	if err != nil || pinned != "" {
+		return pinned, err
+	}
+
+	return locked, nil
+}
+
+// needsPull decides whether or not is needs to be copied into the layer-bases
+// OCI cache at cacheDir, according to the pull policy in effect. locked is
+// the digest is is locked to, if any.
+func needsPull(is *types.ImageSource, config types.StackerConfig, pullPolicy string, cacheDir string, locked digest.Digest) (bool, error) {
+	policy := effectivePullPolicy(is, config, pullPolicy)
+
+	pinned, err := pullDigest(is, locked)
+	if err != nil {
+		return false, err
+	}
+
+	if policy == types.PullAlways && pinned == "" {
+		return true, nil
+	}
+
 	toImport, err := is.ContainersImageURL()
 	if err != nil {
-		return err
+		return false, err
 	}
 
-	tag, err := is.ParseTag()
+	cached, err := hasCachedBase(cacheDir, is)
 	if err != nil {
-		return err
+		return false, err
+	}
+
+	if !cached {
+		cached, err = migrateLegacyCachedBase(cacheDir, is, pinned)
+		if err != nil {
+			return false, err
+		}
 	}
 
+	if cached {
+		cached, err = cachedUnderPolicy(is, config, cacheDir)
+		if err != nil {
+			return false, err
+		}
+
+		if !cached {
+			log.Infof("not using cached copy of %s, it wasn't verified under its current signature policy", toImport)
+		}
+	}
+
+	switch policy {
+	case types.PullAlways:
+		// images pinned (or locked) by digest can't change, so if we
+		// have the right one there's no point in copying it again.
+		if cached && checkCachedDigest(is, cacheDir, pinned) == nil {
+			log.Infof("using cached copy of %s", toImport)
+			return false, nil
+		}
+		return true, nil
+	case types.PullMissing:
+		// a cached copy of some other digest doesn't count
+		if cached && pinned != "" && checkCachedDigest(is, cacheDir, pinned) != nil {
+			log.Infof("cached copy of %s isn't %s, pulling it", toImport, pinned)
+			cached = false
+		}
+
+		if cached {
+			log.Infof("using cached copy of %s", toImport)
+		}
+		return !cached, nil
+	case types.PullNever:
+		if cached {
+			if config.Offline {
+				log.Infof("offline, using cached copy of %s", toImport)
+			} else {
+				log.Infof("using cached copy of %s", toImport)
+			}
+			return false, nil
+		}
+
+		if config.Offline {
+			return false, &types.NeedsNetworkError{Missing: []string{toImport}}
+		}
+
+		return false, errors.Errorf("%s is not in the layer-bases cache and pull policy is never", toImport)
+	default:
+		return false, types.ValidatePullPolicy(policy)
+	}
+}
+
+func importContainersImage(is *types.ImageSource, config types.StackerConfig, pullPolicy string, progress bool, locked digest.Digest) error {
 	// Note that we can do this over the top of the cache every time, since
 	// skopeo should be smart enough to only copy layers that have changed.
 	cacheDir := path.Join(config.StackerDir, "layer-bases", "oci")
@@ -154,23 +326,321 @@ func importContainersImage(is *types.ImageSource, config types.StackerConfig, pr
 		defer oci.Close()
 	}()
 
-	var progressWriter io.Writer
-	if progress {
-		progressWriter = os.Stderr
+	pull, err := needsPull(is, config, pullPolicy, cacheDir, locked)
+	if err != nil {
+		return err
+	}
+
+	if !pull {
+		return nil
 	}
 
-	log.Infof("loading %s", toImport)
-	err = lib.ImageCopy(lib.ImageCopyOpts{
-		Src:      toImport,
-		Dest:     fmt.Sprintf("oci:%s:%s", cacheDir, tag),
-		SkipTLS:  is.Insecure,
-		Progress: progressWriter,
-	})
+	return pullContainersImage(is, config, cacheDir, progress, locked)
+}
+
+// sourceCopyOpts returns the lib.ImageCopyOpts to read the image is with:
+// credentials, certs, and TLS settings come from the registry's entry in the
+// stacker config, and is.CertDir and is.Insecure override them. Image
+// indexes are resolved to the image for is.Platform.
+func sourceCopyOpts(is *types.ImageSource, config types.StackerConfig) (lib.ImageCopyOpts, error) {
+	src, err := is.PullURL()
+	if err != nil {
+		return lib.ImageCopyOpts{}, err
+	}
+
+	registry, err := is.Registry()
+	if err != nil {
+		return lib.ImageCopyOpts{}, err
+	}
+
+	rc := config.Registries[registry]
+
+	username, password, err := registryCredentials(rc, registry)
+	if err != nil {
+		return lib.ImageCopyOpts{}, err
+	}
+
+	opts := lib.ImageCopyOpts{
+		Src:            src,
+		SkipTLS:        is.Insecure || rc.Insecure,
+		SrcUsername:    username,
+		SrcPassword:    password,
+		SrcAuthFile:    config.AuthFile,
+		SrcCertDir:     rc.CertDir,
+		RegistriesConf: config.RegistriesConf,
+		PolicyPath:     signaturePolicy(is, config),
+	}
+
+	if is.CertDir != "" {
+		opts.SrcCertDir = is.CertDir
+	}
+
+	if is.Platform != "" {
+		platform, err := types.ParsePlatform(is.Platform)
+		if err != nil {
+			return lib.ImageCopyOpts{}, err
+		}
+		opts.SrcPlatform = &platform
+	}
+
+	return opts, nil
+}
+
+// signaturePolicy returns the path of the signature policy is must satisfy:
+// its own, or else the global one, or "" if any image is accepted.
+func signaturePolicy(is *types.ImageSource, config types.StackerConfig) string {
+	if is.SignaturePolicy != "" {
+		return is.SignaturePolicy
+	}
+
+	return config.SignaturePolicy
+}
+
+// signaturePolicyDigest identifies the signature policy is must satisfy by
+// the hash of its contents, or "" if there is none. It is recorded with the
+// cached copy of is, so that a copy verified under some other policy (or
+// none at all) isn't used.
+func signaturePolicyDigest(is *types.ImageSource, config types.StackerConfig) (string, error) {
+	policy := signaturePolicy(is, config)
+	if policy == "" {
+		return "", nil
+	}
+
+	h, err := lib.HashFile(policy, false)
 	if err != nil {
-		return errors.Wrapf(err, "couldn't import base layer %s", tag)
+		return "", errors.Wrapf(err, "couldn't read signature policy %s", policy)
 	}
 
-	return err
+	return h, nil
+}
+
+// cachedUnderPolicy returns true if the cached copy of is in the layer-bases
+// OCI layout at cacheDir was verified under the signature policy is must
+// satisfy now.
+func cachedUnderPolicy(is *types.ImageSource, config types.StackerConfig, cacheDir string) (bool, error) {
+	tag, err := is.ParseTag()
+	if err != nil {
+		return false, err
+	}
+
+	annotations, err := cachedBaseAnnotations(cacheDir, tag)
+	if err != nil {
+		return false, err
+	}
+
+	policy, err := signaturePolicyDigest(is, config)
+	if err != nil {
+		return false, err
+	}
+
+	return annotations[SignaturePolicyAnnotation] == policy, nil
+}
+
+// registryCredentials returns the credentials for registry from its
+// configuration: its username and password, or else its credential helper.
+// If it has neither, the credentials are empty, and containers/image looks
+// for them in the auth file, ~/.docker/config.json, and the credential
+// helpers configured there.
+func registryCredentials(rc types.RegistryConfig, registry string) (string, string, error) {
+	if rc.Username != "" || rc.CredentialHelper == "" {
+		return rc.Username, rc.Password, nil
+	}
+
+	return lib.CredentialHelperCredentials(rc.CredentialHelper, registry)
+}
+
+// sourceCandidates returns the lib.ImageCopyOpts to try, in order, to read
+// the image is: first any mirrors configured for it, then is itself. If
+// pinned is set, the image is read by that digest rather than by tag.
+func sourceCandidates(is *types.ImageSource, config types.StackerConfig, pinned digest.Digest) ([]lib.ImageCopyOpts, error) {
+	mirrors, err := is.Mirrors(config.Mirrors)
+	if err != nil {
+		return nil, err
+	}
+
+	candidates := []lib.ImageCopyOpts{}
+	for _, source := range append(mirrors, is) {
+		copyOpts, err := sourceCopyOpts(source, config)
+		if err != nil {
+			return nil, err
+		}
+
+		if pinned != "" {
+			copyOpts.Src, err = source.DigestURL(pinned)
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		candidates = append(candidates, copyOpts)
+	}
+
+	return candidates, nil
+}
+
+// pullContainersImage copies the image is into the OCI layout at dir, using
+// is.ParseTag() as the tag. If is has mirrors configured, they are tried
+// first; the cache tag and recorded source digest are always those of the
+// original reference. Images pinned or locked (to locked) to a digest are
+// pulled by that digest, so the tag moving can't change what is pulled (and
+// containers/image checks that what it pulls matches the digest).
+func pullContainersImage(is *types.ImageSource, config types.StackerConfig, dir string, progress bool, locked digest.Digest) error {
+	pinned, err := pullDigest(is, locked)
+	if err != nil {
+		return err
+	}
+
+	candidates, err := sourceCandidates(is, config, pinned)
+	if err != nil {
+		return err
+	}
+
+	tag, err := is.ParseTag()
+	if err != nil {
+		return err
+	}
+
+	policy, err := signaturePolicyDigest(is, config)
+	if err != nil {
+		return err
+	}
+
+	pull := func(copyOpts lib.ImageCopyOpts) (digest.Digest, error) {
+		if progress {
+			copyOpts.Progress = os.Stderr
+		}
+
+		log.Infof("loading %s", copyOpts.Src)
+		copyOpts.Dest = fmt.Sprintf("oci:%s:%s", dir, tag)
+
+		// containers/image may convert the manifest when copying it
+		// into the OCI layout, so let's remember what digest the
+		// source actually had.
+		sourceDigest, err := lib.ImageCopySourceDigest(copyOpts)
+		if err != nil {
+			return "", errors.Wrapf(err, "couldn't import base layer %s", tag)
+		}
+
+		return sourceDigest, nil
+	}
+
+	for i, copyOpts := range candidates {
+		sourceDigest, err := pull(copyOpts)
+		if err != nil {
+			if i == len(candidates)-1 {
+				return err
+			}
+
+			log.Infof("couldn't pull %s from mirror, trying the next source: %v", is.Url, err)
+			continue
+		}
+
+		err = setCachedBaseAnnotations(dir, tag, map[string]string{
+			SourceDigestAnnotation:    sourceDigest.String(),
+			SignaturePolicyAnnotation: policy,
+		})
+		if err != nil {
+			return err
+		}
+
+		return dropLegacyCachedBase(dir, is)
+	}
+
+	return errors.Errorf("no sources to pull %s from", is.Url)
+}
+
+// setCachedBaseAnnotations records where the image tagged tag in the OCI
+// layout at dir was copied from (the manifest digest it was copied from, and
+// the signature policy it was verified under) as annotations on its index
+// entry.
+func setCachedBaseAnnotations(dir string, tag string, annotations map[string]string) error {
+	oci, err := umoci.OpenLayout(dir)
+	if err != nil {
+		return err
+	}
+	defer oci.Close()
+
+	descriptorPaths, err := oci.ResolveReference(context.Background(), tag)
+	if err != nil {
+		return err
+	}
+
+	if len(descriptorPaths) != 1 {
+		return errors.Errorf("bad descriptor %s", tag)
+	}
+
+	desc := descriptorPaths[0].Root()
+	if desc.Annotations == nil {
+		desc.Annotations = map[string]string{}
+	}
+	for k, v := range annotations {
+		desc.Annotations[k] = v
+	}
+	return oci.UpdateReference(context.Background(), tag, desc)
+}
+
+// checkPinnedDigest makes sure that the cached copy of is in the layer-bases
+// OCI layout at cacheDir came from the digest is is pinned to, if any.
+func checkPinnedDigest(is *types.ImageSource, cacheDir string) error {
+	pinned, err := is.PinnedDigest()
+	if err != nil || pinned == "" {
+		return err
+	}
+
+	return checkCachedDigest(is, cacheDir, pinned)
+}
+
+// checkCachedDigest makes sure that the cached copy of is in the layer-bases
+// OCI layout at cacheDir came from the manifest with digest d.
+func checkCachedDigest(is *types.ImageSource, cacheDir string, d digest.Digest) error {
+	tag, err := is.ParseTag()
+	if err != nil {
+		return err
+	}
+
+	sourceDigest, err := cachedSourceDigest(cacheDir, tag)
+	if err != nil {
+		return err
+	}
+
+	if sourceDigest != d.String() {
+		return errors.Errorf("cached copy of %s is %s, which doesn't match %s", is.Url, sourceDigest, d)
+	}
+
+	return nil
+}
+
+// cachedSourceDigest returns the manifest digest that the image tagged tag in
+// the OCI layout at dir was copied from, or "" if it isn't known (e.g. it was
+// copied by an older version of stacker).
+func cachedSourceDigest(dir string, tag string) (string, error) {
+	annotations, err := cachedBaseAnnotations(dir, tag)
+	if err != nil {
+		return "", err
+	}
+
+	return annotations[SourceDigestAnnotation], nil
+}
+
+// cachedBaseAnnotations returns the annotations setCachedBaseAnnotations
+// recorded for the image tagged tag in the OCI layout at dir.
+func cachedBaseAnnotations(dir string, tag string) (map[string]string, error) {
+	oci, err := umoci.OpenLayout(dir)
+	if err != nil {
+		return nil, err
+	}
+	defer oci.Close()
+
+	descriptorPaths, err := oci.ResolveReference(context.Background(), tag)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(descriptorPaths) != 1 {
+		return nil, errors.Errorf("bad descriptor %s", tag)
+	}
+
+	return descriptorPaths[0].Root().Annotations, nil
 }
 
 func setupContainersImageRootfs(o BaseLayerOpts) error {
@@ -219,27 +689,15 @@ func setupContainersImageRootfs(o BaseLayerOpts) error {
 	}
 	log.Debugf("translating from %s to %s", sourceLayerType, o.LayerType)
 
-	var blob io.ReadCloser
-
-	bundlePath := path.Join(o.Config.RootFSDir, o.Name)
-	rootfsPath := path.Join(bundlePath, "rootfs")
+	rootfsPath := path.Join(o.Config.RootFSDir, o.Name, "rootfs")
 	// otherwise, render the right layer type
 	if o.LayerType == "squashfs" {
 		// sourced a non-squashfs image and wants a squashfs layer,
 		// let's generate one.
 		o.OCI.GC(context.Background())
-
-		blob, err = squashfs.MakeSquashfs(o.Config.OCIDir, rootfsPath, nil)
-		if err != nil {
-			return err
-		}
-		defer blob.Close()
-	} else {
-		blob = layer.GenerateInsertLayer(path.Join(bundlePath, "rootfs"), "/", false, nil)
-		defer blob.Close()
 	}
 
-	layerDigest, layerSize, err := o.OCI.PutBlob(context.Background(), blob)
+	desc, diffID, err := renderLayer(o.OCI, o.Config.OCIDir, rootfsPath, o.LayerType, false)
 	if err != nil {
 		return err
 	}
@@ -254,19 +712,8 @@ func setupContainersImageRootfs(o BaseLayerOpts) error {
 		return err
 	}
 
-	layerType := stackeroci.MediaTypeLayerSquashfs
-	if o.LayerType == "tar" {
-		layerType = ispec.MediaTypeImageLayerGzip
-	}
-
-	desc := ispec.Descriptor{
-		MediaType: layerType,
-		Digest:    layerDigest,
-		Size:      layerSize,
-	}
-
 	manifest.Layers = []ispec.Descriptor{desc}
-	config.RootFS.DiffIDs = []digest.Digest{layerDigest}
+	config.RootFS.DiffIDs = []digest.Digest{diffID}
 	now := time.Now()
 	config.History = []ispec.History{{
 		Created:   &now,
@@ -306,6 +753,76 @@ func setupContainersImageRootfs(o BaseLayerOpts) error {
 	})
 }
 
+// renderLayer adds a single layer of layerType (tar or squashfs) with the
+// contents of rootfsPath to oci, and returns its descriptor and diff id.
+// Squashfs images are built in tempDir first. Tar layers are gzip compressed
+// if compress is set; otherwise they are stored as is (though still labeled
+// as gzip), which is how builds have always converted their bases.
+func renderLayer(oci casext.Engine, tempDir string, rootfsPath string, layerType string, compress bool) (ispec.Descriptor, digest.Digest, error) {
+	if layerType == "squashfs" {
+		blob, err := squashfs.MakeSquashfs(tempDir, rootfsPath, nil)
+		if err != nil {
+			return ispec.Descriptor{}, "", err
+		}
+		defer blob.Close()
+
+		// squashfs layers aren't compressed, so the diff id is the
+		// blob's digest
+		layerDigest, layerSize, err := oci.PutBlob(context.Background(), blob)
+		if err != nil {
+			return ispec.Descriptor{}, "", err
+		}
+
+		desc := ispec.Descriptor{
+			MediaType: stackeroci.MediaTypeLayerSquashfs,
+			Digest:    layerDigest,
+			Size:      layerSize,
+		}
+		return desc, layerDigest, nil
+	}
+
+	uncompressed := layer.GenerateInsertLayer(rootfsPath, "/", false, nil)
+	defer uncompressed.Close()
+
+	if !compress {
+		layerDigest, layerSize, err := oci.PutBlob(context.Background(), uncompressed)
+		if err != nil {
+			return ispec.Descriptor{}, "", err
+		}
+
+		desc := ispec.Descriptor{
+			MediaType: ispec.MediaTypeImageLayerGzip,
+			Digest:    layerDigest,
+			Size:      layerSize,
+		}
+		return desc, layerDigest, nil
+	}
+
+	diffID := digest.SHA256.Digester()
+	reader, writer := io.Pipe()
+	go func() {
+		gz := pgzip.NewWriter(writer)
+		_, err := io.Copy(gz, io.TeeReader(uncompressed, diffID.Hash()))
+		if err == nil {
+			err = gz.Close()
+		}
+		writer.CloseWithError(err)
+	}()
+
+	layerDigest, layerSize, err := oci.PutBlob(context.Background(), reader)
+	reader.CloseWithError(errors.Errorf("layer wasn't completely written"))
+	if err != nil {
+		return ispec.Descriptor{}, "", err
+	}
+
+	desc := ispec.Descriptor{
+		MediaType: ispec.MediaTypeImageLayerGzip,
+		Digest:    layerDigest,
+		Size:      layerSize,
+	}
+	return desc, diffID.Digest(), nil
+}
+
 func setupTarRootfs(o BaseLayerOpts) error {
 	// initialize an empty image, then extract it
 	cacheDir := path.Join(o.Config.StackerDir, "layer-bases")
@@ -313,31 +830,75 @@ func setupTarRootfs(o BaseLayerOpts) error {
 
 	// TODO: make this respect ID maps
 	layerPath := path.Join(o.Config.RootFSDir, o.Name, "rootfs")
+	return unpackTar(tar, layerPath)
+}
+
+// unpackTar extracts the tar archive at tar into dir. The archive may be
+// uncompressed, or compressed with gzip, bzip2, xz, or zstd.
+func unpackTar(tar string, dir string) error {
 	tarReader, err := os.Open(tar)
 	if err != nil {
 		return errors.Wrapf(err, "couldn't open %s", tar)
 	}
 	defer tarReader.Close()
-	var uncompressed io.ReadCloser
-	uncompressed, err = pgzip.NewReader(tarReader)
+
+	uncompressed, _, err := compression.AutoDecompress(tarReader)
 	if err != nil {
-		_, err = tarReader.Seek(0, os.SEEK_SET)
-		if err != nil {
-			return errors.Wrapf(err, "failed to 0 seek %s", tar)
-		}
-		uncompressed = tarReader
-	} else {
-		defer uncompressed.Close()
+		return errors.Wrapf(err, "couldn't decompress %s", tar)
 	}
+	defer uncompressed.Close()
 
-	err = layer.UnpackLayer(layerPath, uncompressed, &layer.UnpackOptions{KeepDirlinks: true})
+	err = layer.UnpackLayer(dir, uncompressed, &layer.UnpackOptions{KeepDirlinks: true})
+	if err != nil {
+		return errors.Wrapf(err, "couldn't extract %s", tar)
+	}
+
+	return nil
+}
+
+func setupSquashfsRootfs(o BaseLayerOpts) error {
+	cacheDir := path.Join(o.Config.StackerDir, "layer-bases")
+	image := path.Join(cacheDir, path.Base(o.Layer.From.Url))
+	layerPath := path.Join(o.Config.RootFSDir, o.Name, "rootfs")
+
+	output, err := exec.Command("unsquashfs", "-f", "-d", layerPath, image).CombinedOutput()
+	if err != nil {
+		return errors.Wrapf(err, "couldn't extract %s: %s", image, string(output))
+	}
+
+	return nil
+}
+
+func setupDirRootfs(o BaseLayerOpts) error {
+	layerPath := path.Join(o.Config.RootFSDir, o.Name, "rootfs")
+
+	dir, err := o.Layer.ParseDirBase()
 	if err != nil {
 		return err
 	}
 
+	// the trailing /. copies the contents of the directory, not the
+	// directory itself.
+	output, err := exec.Command("cp", "-a", dir+"/.", layerPath).CombinedOutput()
+	if err != nil {
+		return errors.Wrapf(err, "couldn't copy %s: %s", dir, string(output))
+	}
+
 	return nil
 }
 
+// hasOCILayers returns true if the base type comes with OCI layers of its
+// own; the others (tar, squashfs, dir, scratch) are generated from an empty
+// image.
+func hasOCILayers(baseType string) bool {
+	switch baseType {
+	case types.ScratchLayer, types.TarLayer, types.SquashfsLayer, types.DirLayer:
+		return false
+	default:
+		return true
+	}
+}
+
 func copyBuiltTypeBaseToOutput(o BaseLayerOpts, sfm types.StackerFiles) error {
 	// We need to copy any base OCI layers to the output dir, since they
 	// may not have been copied before and the final `umoci repack` expects
@@ -357,7 +918,7 @@ func copyBuiltTypeBaseToOutput(o BaseLayerOpts, sfm types.StackerFiles) error {
 		var err error
 
 		baseType = base.From.Type
-		if baseType == types.ScratchLayer || baseType == types.TarLayer {
+		if !hasOCILayers(baseType) {
 			break
 		}
 
@@ -380,12 +941,12 @@ func copyBuiltTypeBaseToOutput(o BaseLayerOpts, sfm types.StackerFiles) error {
 		}
 	}
 
-	if (baseType == types.ScratchLayer || baseType == types.TarLayer) && base.BuildOnly {
+	if !hasOCILayers(baseType) && base.BuildOnly {
 		// The base layers cannot be copied, so initialize an empty OCI tag.
 		return umoci.NewImage(o.OCI, targetName)
 	}
 
-	if baseType != types.DockerLayer && baseType != types.OCILayer {
+	if baseType != types.DockerLayer && baseType != types.OCILayer && baseType != types.ContainersStorageLayer {
 		return lib.ImageCopy(lib.ImageCopyOpts{
 			Src:  fmt.Sprintf("oci:%s:%s", o.Config.OCIDir, baseTag),
 			Dest: fmt.Sprintf("oci:%s:%s", o.Config.OCIDir, targetName),
@@ -7,7 +7,6 @@ import (
 	"os"
 	"os/user"
 	"path"
-	"runtime"
 	"strings"
 	"time"
 
@@ -31,12 +30,20 @@ type BuildArgs struct {
 	OrderOnly               bool
 	SetupOnly               bool
 	Progress                bool
+	PullPolicy              string
+	UpdateLock              bool
+	ApplyDryRun             bool
 }
 
 // Builder is responsible for building the layers based on stackerfiles
 type Builder struct {
 	builtStackerfiles types.StackerFiles // Keep track of all the Stackerfiles which were built
 	opts              *BuildArgs         // Build options
+
+	// for --apply-dry-run: the conflicts found so far, and the layers that
+	// were only dry run (and so don't have any output to build on)
+	conflicts []string
+	dryRun    map[string]bool
 }
 
 // NewBuilder initializes a new Builder struct
@@ -44,18 +51,41 @@ func NewBuilder(opts *BuildArgs) *Builder {
 	return &Builder{
 		builtStackerfiles: make(map[string]*types.Stackerfile, 1),
 		opts:              opts,
+		dryRun:            map[string]bool{},
 	}
 }
 
 // Build builds a single stackerfile
 func (b *Builder) Build(file string) error {
+	b.conflicts = nil
+	if err := b.build(file); err != nil {
+		return err
+	}
+
+	return b.conflictsError()
+}
+
+// conflictsError returns the error for the conflicts --apply-dry-run found,
+// if there were any.
+func (b *Builder) conflictsError() error {
+	if len(b.conflicts) == 0 {
+		return nil
+	}
+
+	return errors.Errorf("apply dry run found %d conflicts:\n%s", len(b.conflicts), strings.Join(b.conflicts, "\n"))
+}
+
+// build builds a single stackerfile, recording the conflicts --apply-dry-run
+// finds in b rather than failing on them, so that they can be reported
+// together with those of other stackerfiles.
+func (b *Builder) build(file string) error {
 	opts := b.opts
 
 	if opts.NoCache {
 		os.RemoveAll(opts.Config.StackerDir)
 	}
 
-	sf, err := types.NewStackerfile(file, append(opts.Substitute, b.opts.Config.Substitutions()...))
+	sf, err := types.NewStackerfile(file, append(opts.Substitute, b.opts.Config.Substitutions()...), opts.Config)
 	if err != nil {
 		return err
 	}
@@ -73,6 +103,11 @@ func (b *Builder) Build(file string) error {
 		return err
 	}
 
+	lock, err := newLockChecker(sf, opts.UpdateLock)
+	if err != nil {
+		return err
+	}
+
 	var oci casext.Engine
 	if _, statErr := os.Stat(opts.Config.OCIDir); statErr != nil {
 		oci, err = umoci.CreateLayout(opts.Config.OCIDir)
@@ -121,6 +156,12 @@ func (b *Builder) Build(file string) error {
 			return errors.Errorf("%s not present in stackerfile?", name)
 		}
 
+		if l.From.Type == types.BuiltLayer && b.dryRun[l.From.Tag] {
+			log.Infof("skipping %s, its base %s was only dry run", name, l.From.Tag)
+			b.dryRun[name] = true
+			continue
+		}
+
 		// if a container builds on another container in a stacker
 		// file, we can't correctly render the dependent container's
 		// filesystem, since we don't know what the output of the
@@ -150,6 +191,13 @@ func (b *Builder) Build(file string) error {
 			return err
 		}
 
+		for _, imp := range imports {
+			diskPath := path.Join(opts.Config.StackerDir, "imports", name, path.Base(imp))
+			if err := lock.checkImport(imp, diskPath); err != nil {
+				return err
+			}
+		}
+
 		// Need to check if the image has bind mounts, if the image has bind mounts,
 		// it needs to be rebuilt regardless of the build cache
 		// The reason is that tracking build cache for bind mounted folders
@@ -160,14 +208,16 @@ func (b *Builder) Build(file string) error {
 		}
 
 		baseOpts := BaseLayerOpts{
-			Config:    opts.Config,
-			Name:      name,
-			Layer:     l,
-			Cache:     buildCache,
-			OCI:       oci,
-			LayerType: opts.LayerType,
-			Storage:   s,
-			Progress:  opts.Progress,
+			Config:     opts.Config,
+			Name:       name,
+			Layer:      l,
+			Cache:      buildCache,
+			OCI:        oci,
+			LayerType:  opts.LayerType,
+			Storage:    s,
+			Progress:   opts.Progress,
+			PullPolicy: opts.PullPolicy,
+			Lock:       lock,
 		}
 
 		if err := GetBase(baseOpts); err != nil {
@@ -178,7 +228,10 @@ func (b *Builder) Build(file string) error {
 		if err != nil {
 			return err
 		}
-		if cacheHit && (len(binds) == 0) {
+		// applies are dry run even if the layer is cached, so that
+		// every conflict is reported.
+		dryRunApply := opts.ApplyDryRun && len(l.Apply) > 0
+		if cacheHit && (len(binds) == 0) && !dryRunApply {
 			if l.BuildOnly {
 				if cacheEntry.Name != name {
 					err = s.Snapshot(cacheEntry.Name, name)
@@ -201,7 +254,7 @@ func (b *Builder) Build(file string) error {
 			return err
 		}
 
-		apply, err := NewApply(b.builtStackerfiles, baseOpts, s, opts.ApplyConsiderTimestamps)
+		apply, err := NewApply(b.builtStackerfiles, baseOpts, s, opts.ApplyConsiderTimestamps, opts.ApplyDryRun)
 		if err != nil {
 			return err
 		}
@@ -211,6 +264,23 @@ func (b *Builder) Build(file string) error {
 			return err
 		}
 
+		if dryRunApply {
+			log.Infof("apply dry run for %s found %d conflicts", name, len(apply.Conflicts()))
+			b.conflicts = append(b.conflicts, apply.Conflicts()...)
+			b.dryRun[name] = true
+			continue
+		}
+
+		structuredImports, err := l.ParseImports()
+		if err != nil {
+			return err
+		}
+
+		err = ExtractImports(opts.Config, name, structuredImports)
+		if err != nil {
+			return err
+		}
+
 		c, err := NewContainer(opts.Config, name)
 		if err != nil {
 			return err
@@ -436,9 +506,14 @@ func (b *Builder) Build(file string) error {
 			return err
 		}
 
+		platform, err := l.ParsePlatform()
+		if err != nil {
+			return err
+		}
+
 		meta.Created = time.Now()
-		meta.Architecture = runtime.GOARCH
-		meta.OS = runtime.GOOS
+		meta.Architecture = platform.Architecture
+		meta.OS = platform.OS
 		meta.Author = author
 
 		annotations, err := mutator.Annotations(context.Background())
@@ -496,6 +571,10 @@ func (b *Builder) Build(file string) error {
 		}
 	}
 
+	if err := lock.persist(); err != nil {
+		return err
+	}
+
 	return oci.GC(context.Background())
 }
 
@@ -504,8 +583,13 @@ func (b *Builder) BuildMultiple(paths []string) error {
 	opts := b.opts
 
 	// Read all the stacker recipes
-	stackerFiles, err := types.NewStackerFiles(paths, append(opts.Substitute, b.opts.Config.Substitutions()...))
+	stackerFiles, err := types.NewStackerFiles(paths, append(opts.Substitute, b.opts.Config.Substitutions()...), opts.Config)
 	if err != nil {
+		// report the stackerfiles that aren't cached along with
+		// everything else the ones that are need
+		if nne, ok := err.(*types.NeedsNetworkError); ok {
+			return checkOfflineInputs(opts.Config, stackerFiles, nne.Missing)
+		}
 		return err
 	}
 
@@ -532,15 +616,25 @@ func (b *Builder) BuildMultiple(paths []string) error {
 		return nil
 	}
 
-	// Build all Stackerfiles
+	if opts.Config.Offline {
+		// Make sure everything is available before we start building,
+		// so we don't fail halfway through.
+		if err := checkOfflineInputs(opts.Config, stackerFiles, nil); err != nil {
+			return err
+		}
+	}
+
+	// Build all Stackerfiles, reporting the conflicts --apply-dry-run
+	// finds in any of them together at the end
+	b.conflicts = nil
 	for i, p := range sortedPaths {
 		log.Debugf("building: %d %s\n", i, p)
 
-		err = b.Build(p)
+		err = b.build(p)
 		if err != nil {
 			return err
 		}
 	}
 
-	return nil
+	return b.conflictsError()
 }
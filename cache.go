@@ -14,6 +14,7 @@ import (
 	"github.com/anuvu/stacker/log"
 	"github.com/anuvu/stacker/types"
 	"github.com/mitchellh/hashstructure"
+	"github.com/opencontainers/go-digest"
 	ispec "github.com/opencontainers/image-spec/specs-go/v1"
 	"github.com/opencontainers/umoci"
 	"github.com/opencontainers/umoci/oci/casext"
@@ -269,6 +270,28 @@ func getEncodedMtree(path string) (string, error) {
 	return base64.StdEncoding.EncodeToString(buf.Bytes()), nil
 }
 
+// hashDir returns a hash of dir's mtree (without mtimes, like imports), so
+// that it changes whenever anything in dir does.
+func hashDir(dir string) (string, error) {
+	dh, err := walkImport(dir)
+	if err != nil {
+		return "", err
+	}
+
+	digester := digest.Canonical.Digester()
+	for _, e := range dh.Entries {
+		// skip the comments at the top that say who generated this
+		// when
+		if e.Type == mtree.CommentType {
+			continue
+		}
+
+		fmt.Fprintln(digester.Hash(), e.String())
+	}
+
+	return digester.Digest().Encoded(), nil
+}
+
 // getBaseHash returns some kind of "hash" for the base layer, whatever type it
 // may be.
 func (c *BuildCache) getBaseHash(name string) (string, error) {
@@ -277,6 +300,44 @@ func (c *BuildCache) getBaseHash(name string) (string, error) {
 		return "", errors.Errorf("%s missing from stackerfile?", name)
 	}
 
+	baseHash, err := c.getFromHash(name, l)
+	if err != nil {
+		return "", err
+	}
+
+	// layers applied from this build are inputs just like a built base
+	// is, so fold the hashes of their cache entries in too.
+	applies, err := l.ParseApply()
+	if err != nil {
+		return "", err
+	}
+
+	for _, apply := range applies {
+		if apply.Type != types.BuiltLayer {
+			continue
+		}
+
+		applyEnt, ok, err := c.Lookup(apply.Tag)
+		if err != nil {
+			return "", err
+		}
+		if !ok {
+			return "", errors.Errorf("couldn't find a cache of applied layer for %s: %s", name, apply.Tag)
+		}
+
+		applyHash, err := hashstructure.Hash(applyEnt, nil)
+		if err != nil {
+			return "", err
+		}
+
+		baseHash = fmt.Sprintf("%s+%d", baseHash, applyHash)
+	}
+
+	return baseHash, nil
+}
+
+// getFromHash returns the hash of the layer's from: base.
+func (c *BuildCache) getFromHash(name string, l *types.Layer) (string, error) {
 	switch l.From.Type {
 	case types.BuiltLayer:
 		// for built type, just use the hash of the cache entry
@@ -302,7 +363,18 @@ func (c *BuildCache) getBaseHash(name string) (string, error) {
 		cacheDir := path.Join(c.config.StackerDir, "layer-bases")
 		tar := path.Join(cacheDir, path.Base(l.From.Url))
 		return lib.HashFile(tar, true)
-	case types.OCILayer:
+	case types.SquashfsLayer:
+		cacheDir := path.Join(c.config.StackerDir, "layer-bases")
+		image := path.Join(cacheDir, path.Base(l.From.Url))
+		return lib.HashFile(image, true)
+	case types.DirLayer:
+		dir, err := l.ParseDirBase()
+		if err != nil {
+			return "", err
+		}
+
+		return hashDir(dir)
+	case types.OCILayer, types.ContainersStorageLayer:
 		fallthrough
 	case types.DockerLayer:
 		tag, err := l.From.ParseTag()
@@ -310,8 +382,13 @@ func (c *BuildCache) getBaseHash(name string) (string, error) {
 			return "", err
 		}
 
+		cacheDir := path.Join(c.config.StackerDir, "layer-bases", "oci")
+		if err := checkPinnedDigest(l.From, cacheDir); err != nil {
+			return "", err
+		}
+
 		// use the manifest hash of the thing in the cache
-		oci, err := umoci.OpenLayout(path.Join(c.config.StackerDir, "layer-bases", "oci"))
+		oci, err := umoci.OpenLayout(cacheDir)
 		if err != nil {
 			return "", err
 		}
@@ -36,7 +36,17 @@ func TestLayerHashing(t *testing.T) {
 	}
 	defer oci.Close()
 
-	err = umoci.NewImage(oci, "centos")
+	is, err := types.NewImageSource("docker://centos:latest")
+	if err != nil {
+		t.Fatalf("couldn't parse image source %v", err)
+	}
+
+	tag, err := is.ParseTag()
+	if err != nil {
+		t.Fatalf("couldn't get cache tag %v", err)
+	}
+
+	err = umoci.NewImage(oci, tag)
 	if err != nil {
 		t.Fatalf("couldn't create fake centos image %v", err)
 	}
@@ -54,7 +64,7 @@ foo:
 		t.Fatalf("couldn't write stacker yaml %v", err)
 	}
 
-	sf, err := types.NewStackerfile(stackerYaml, nil)
+	sf, err := types.NewStackerfile(stackerYaml, nil, config)
 	if err != nil {
 		t.Fatalf("couldn't read stacker file %v", err)
 	}
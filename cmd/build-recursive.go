@@ -44,6 +44,12 @@ func beforeRecursiveBuild(ctx *cli.Context) error {
 		return err
 	}
 
+	// Validate pull policy
+	err = validatePullPolicyFlags(ctx)
+	if err != nil {
+		return err
+	}
+
 	// Validate search arguments
 	err = validateFileSearchFlags(ctx)
 	if err != nil {
@@ -50,6 +50,10 @@ func initCommonBuildFlags() []cli.Flag {
 			Name:  "apply-consider-timestamps",
 			Usage: "for apply layer merging, fail if timestamps on files don't match",
 		},
+		cli.BoolFlag{
+			Name:  "apply-dry-run",
+			Usage: "report every apply conflict without applying anything; layers with apply statements (and layers built on them) aren't built",
+		},
 		cli.StringFlag{
 			Name:  "layer-type",
 			Usage: "set the output layer type (supported values: tar, squashfs)",
@@ -59,6 +63,15 @@ func initCommonBuildFlags() []cli.Flag {
 			Name:  "order-only",
 			Usage: "show the build order without running the actual build",
 		},
+		cli.StringFlag{
+			Name:  "pull",
+			Usage: "when to copy docker/oci bases into the cache (supported values: always, missing, never)",
+			Value: "always",
+		},
+		cli.BoolFlag{
+			Name:  "update-lock",
+			Usage: "update the stackerfile's lockfile with the inputs used instead of failing when they don't match it",
+		},
 	}
 }
 
@@ -75,6 +88,12 @@ func beforeBuild(ctx *cli.Context) error {
 	if err != nil {
 		return err
 	}
+
+	// Validate pull policy
+	err = validatePullPolicyFlags(ctx)
+	if err != nil {
+		return err
+	}
 	return nil
 }
 
@@ -89,6 +108,9 @@ func newBuildArgs(ctx *cli.Context) stacker.BuildArgs {
 		LayerType:               ctx.String("layer-type"),
 		OrderOnly:               ctx.Bool("order-only"),
 		Progress:                shouldShowProgress(ctx),
+		PullPolicy:              ctx.String("pull"),
+		UpdateLock:              ctx.Bool("update-lock"),
+		ApplyDryRun:             ctx.Bool("apply-dry-run"),
 	}
 }
 
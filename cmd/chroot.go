@@ -68,7 +68,7 @@ func doChroot(ctx *cli.Context) error {
 		defer c.Close()
 		return c.Execute(cmd, os.Stdin)
 	}
-	sf, err := types.NewStackerfile(file, ctx.StringSlice("substitute"))
+	sf, err := types.NewStackerfile(file, ctx.StringSlice("substitute"), config)
 	if err != nil {
 		return err
 	}
@@ -55,6 +55,12 @@ func doClean(ctx *cli.Context) error {
 				fail = true
 			}
 		}
+		// publish --layer-type conversions of the images that were
+		// just deleted
+		if err := os.RemoveAll(path.Join(config.StackerDir, "publish-layer-types")); err != nil {
+			log.Infof("error deleting converted images: %v", err)
+			fail = true
+		}
 	} else {
 		if err := os.RemoveAll(config.StackerDir); err != nil {
 			if !os.IsNotExist(err) {
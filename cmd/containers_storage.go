@@ -0,0 +1,9 @@
+//go:build !containers_image_storage_stub
+// +build !containers_image_storage_stub
+
+package main
+
+// containers-storage bases and apply images need the containers/storage
+// transport, which pulls in a lot of (C) dependencies; build with
+// containers_image_storage_stub to leave it out.
+import _ "github.com/anuvu/stacker/lib/containers_storage"
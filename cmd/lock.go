@@ -0,0 +1,64 @@
+package main
+
+import (
+	"github.com/anuvu/stacker"
+	"github.com/anuvu/stacker/lib"
+	"github.com/urfave/cli"
+)
+
+var lockCmd = cli.Command{
+	Name:   "lock",
+	Usage:  "resolves the network inputs of stacker yaml files and records them in a lockfile next to each",
+	Action: doLock,
+	Flags: []cli.Flag{
+		cli.StringFlag{
+			Name:  "stacker-file, f",
+			Usage: "the input stackerfile",
+			Value: "stacker.yaml",
+		},
+		cli.StringFlag{
+			Name:  "stacker-file-pattern, p",
+			Usage: "regex pattern to use when searching for stackerfile paths",
+			Value: "stacker.yaml",
+		},
+		cli.StringFlag{
+			Name:  "search-dir, d",
+			Usage: "directory under which to search for stackerfiles to lock",
+		},
+		cli.StringSliceFlag{
+			Name:  "substitute",
+			Usage: "variable substitution in stackerfiles, FOO=bar format",
+		},
+	},
+	Before: beforeLock,
+}
+
+func beforeLock(ctx *cli.Context) error {
+	if len(ctx.String("search-dir")) != 0 {
+		return validateFileSearchFlags(ctx)
+	}
+
+	return nil
+}
+
+func doLock(ctx *cli.Context) error {
+	args := stacker.LockArgs{
+		Config:     config,
+		Substitute: ctx.StringSlice("substitute"),
+		Progress:   shouldShowProgress(ctx),
+	}
+
+	var stackerFiles []string
+	var err error
+	if len(ctx.String("search-dir")) > 0 {
+		stackerFiles, err = lib.FindFiles(ctx.String("search-dir"), ctx.String("stacker-file-pattern"))
+	} else {
+		stackerFiles = []string{ctx.String("stacker-file")}
+	}
+
+	if err != nil {
+		return err
+	}
+
+	return stacker.Lock(args, stackerFiles)
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"github.com/anuvu/stacker/lib"
+	"github.com/anuvu/stacker/log"
+	"github.com/pkg/errors"
+	"github.com/urfave/cli"
+	"golang.org/x/crypto/ssh/terminal"
+)
+
+var loginCmd = cli.Command{
+	Name:   "login",
+	Usage:  "stores credentials for a registry in the auth file, for publishing and pulling",
+	Action: doLogin,
+	Flags: []cli.Flag{
+		cli.StringFlag{
+			Name:  "username",
+			Usage: "username for the registry",
+		},
+		cli.StringFlag{
+			Name:  "password",
+			Usage: "password for the registry (prefer --password-stdin, this shows up in process listings)",
+		},
+		cli.BoolFlag{
+			Name:  "password-stdin",
+			Usage: "read the password for the registry from stdin",
+		},
+		cli.BoolTFlag{
+			Name:  "tls-verify",
+			Usage: "verify the registry's TLS certificate",
+		},
+		cli.StringFlag{
+			Name:  "cert-dir",
+			Usage: "directory with the CA certificates (*.crt) and client certificates (*.cert, *.key) for the registry",
+		},
+	},
+	ArgsUsage: `<registry>
+
+<registry> is the registry (host, and port if any) to log in to. The
+credentials are checked against the registry unless --offline is passed.`,
+}
+
+var logoutCmd = cli.Command{
+	Name:   "logout",
+	Usage:  "removes credentials for a registry from the auth file",
+	Action: doLogout,
+	Flags: []cli.Flag{
+		cli.BoolFlag{
+			Name:  "all",
+			Usage: "remove the credentials for every registry",
+		},
+	},
+	ArgsUsage: `<registry>`,
+}
+
+// readPassword returns the password from --password or --password-stdin.
+func readPassword(ctx *cli.Context) (string, error) {
+	if !ctx.Bool("password-stdin") {
+		return ctx.String("password"), nil
+	}
+
+	if ctx.String("password") != "" {
+		return "", errors.Errorf("--password and --password-stdin don't make sense together")
+	}
+
+	content, err := ioutil.ReadAll(os.Stdin)
+	if err != nil {
+		return "", errors.Wrapf(err, "couldn't read password from stdin")
+	}
+
+	return strings.TrimRight(string(content), "\r\n"), nil
+}
+
+func doLogin(ctx *cli.Context) error {
+	registry := strings.TrimSuffix(strings.TrimPrefix(ctx.Args().First(), "docker://"), "/")
+	if registry == "" {
+		return errors.Errorf("need a registry to log in to")
+	}
+
+	username := ctx.String("username")
+	if username == "" {
+		return errors.Errorf("--username is a mandatory argument for login")
+	}
+
+	password, err := readPassword(ctx)
+	if err != nil {
+		return err
+	}
+
+	if password == "" && !ctx.Bool("password-stdin") && terminal.IsTerminal(int(os.Stdin.Fd())) {
+		fmt.Fprint(os.Stderr, "Password: ")
+		content, err := terminal.ReadPassword(int(os.Stdin.Fd()))
+		fmt.Fprint(os.Stderr, "\n")
+		if err != nil {
+			return err
+		}
+		password = string(content)
+	}
+
+	if password == "" {
+		return errors.Errorf("need a password, pass --password-stdin")
+	}
+
+	rc := config.Registries[registry]
+	certDir := rc.CertDir
+	if ctx.String("cert-dir") != "" {
+		certDir = ctx.String("cert-dir")
+	}
+
+	err = lib.Login(lib.LoginOpts{
+		AuthFile:  config.AuthFile,
+		Registry:  registry,
+		Username:  username,
+		Password:  password,
+		SkipCheck: config.Offline,
+		SkipTLS:   !ctx.BoolT("tls-verify") || rc.Insecure,
+		CertDir:   certDir,
+	})
+	if err != nil {
+		return err
+	}
+
+	log.Infof("logged in to %s", registry)
+	return nil
+}
+
+func doLogout(ctx *cli.Context) error {
+	registry := strings.TrimSuffix(strings.TrimPrefix(ctx.Args().First(), "docker://"), "/")
+	if ctx.Bool("all") {
+		if registry != "" {
+			return errors.Errorf("--all and a registry don't make sense together")
+		}
+		return lib.Logout(config.AuthFile, "")
+	}
+
+	if registry == "" {
+		return errors.Errorf("need a registry to log out of, or --all")
+	}
+
+	if err := lib.Logout(config.AuthFile, registry); err != nil {
+		return err
+	}
+
+	log.Infof("logged out of %s", registry)
+	return nil
+}
@@ -50,6 +50,9 @@ func main() {
 		buildCmd,
 		recursiveBuildCmd,
 		publishCmd,
+		verifyCmd,
+		loginCmd,
+		logoutCmd,
 		chrootCmd,
 		cleanCmd,
 		inspectCmd,
@@ -58,6 +61,8 @@ func main() {
 		unprivSetupCmd,
 		gcCmd,
 		containerSetupCmd,
+		prefetchCmd,
+		lockCmd,
 	}
 
 	configDir := os.Getenv("XDG_CONFIG_HOME")
@@ -104,6 +109,14 @@ func main() {
 			// default to btrfs for now since it's less experimental
 			Value: "btrfs",
 		},
+		cli.BoolFlag{
+			Name:  "offline",
+			Usage: "never access the network; only use inputs from stacker's caches",
+		},
+		cli.StringFlag{
+			Name:  "auth-file",
+			Usage: "the auth.json for registry credentials, as managed by stacker login (defaults to containers/image's)",
+		},
 	}
 
 	/*
@@ -169,6 +182,9 @@ func main() {
 		if config.RootFSDir == "" || ctx.IsSet("roots-dir") {
 			config.RootFSDir = ctx.String("roots-dir")
 		}
+		if ctx.IsSet("auth-file") {
+			config.AuthFile = ctx.String("auth-file")
+		}
 
 		config.StackerDir, err = filepath.Abs(config.StackerDir)
 		if err != nil {
@@ -185,6 +201,7 @@ func main() {
 		}
 
 		config.StorageType = ctx.String("storage-type")
+		config.Offline = ctx.Bool("offline")
 
 		var handler log.Handler
 		handler = stackerlog.NewTextHandler(os.Stderr)
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"github.com/anuvu/stacker"
+	"github.com/anuvu/stacker/lib"
+	"github.com/urfave/cli"
+)
+
+var prefetchCmd = cli.Command{
+	Name:   "prefetch",
+	Usage:  "downloads the base images and apply sources of stacker yaml files into the cache",
+	Action: doPrefetch,
+	Flags: []cli.Flag{
+		cli.StringFlag{
+			Name:  "stacker-file, f",
+			Usage: "the input stackerfile",
+			Value: "stacker.yaml",
+		},
+		cli.StringFlag{
+			Name:  "stacker-file-pattern, p",
+			Usage: "regex pattern to use when searching for stackerfile paths",
+			Value: "stacker.yaml",
+		},
+		cli.StringFlag{
+			Name:  "search-dir, d",
+			Usage: "directory under which to search for stackerfiles to prefetch",
+		},
+		cli.StringSliceFlag{
+			Name:  "substitute",
+			Usage: "variable substitution in stackerfiles, FOO=bar format",
+		},
+		cli.StringFlag{
+			Name:  "pull",
+			Usage: "when to copy docker/oci bases into the cache (supported values: always, missing, never)",
+			Value: "always",
+		},
+		cli.IntFlag{
+			Name:  "jobs, j",
+			Usage: "number of images to download in parallel",
+			Value: 4,
+		},
+	},
+	Before: beforePrefetch,
+}
+
+func beforePrefetch(ctx *cli.Context) error {
+	if len(ctx.String("search-dir")) != 0 {
+		err := validateFileSearchFlags(ctx)
+		if err != nil {
+			return err
+		}
+	}
+
+	return validatePullPolicyFlags(ctx)
+}
+
+func doPrefetch(ctx *cli.Context) error {
+	args := stacker.PrefetchArgs{
+		Config:     config,
+		Substitute: ctx.StringSlice("substitute"),
+		PullPolicy: ctx.String("pull"),
+		Jobs:       ctx.Int("jobs"),
+		Progress:   shouldShowProgress(ctx),
+	}
+
+	var stackerFiles []string
+	var err error
+	if len(ctx.String("search-dir")) > 0 {
+		stackerFiles, err = lib.FindFiles(ctx.String("search-dir"), ctx.String("stacker-file-pattern"))
+	} else {
+		stackerFiles = []string{ctx.String("stacker-file")}
+	}
+
+	if err != nil {
+		return err
+	}
+
+	return stacker.Prefetch(args, stackerFiles)
+}
@@ -36,7 +36,11 @@ var publishCmd = cli.Command{
 		},
 		cli.StringFlag{
 			Name:  "password",
-			Usage: "password for the registry where the OCI images are published",
+			Usage: "password for the registry where the OCI images are published (prefer --password-stdin, this shows up in process listings)",
+		},
+		cli.BoolFlag{
+			Name:  "password-stdin",
+			Usage: "read the password for the registry where the OCI images are published from stdin",
 		},
 		cli.StringSliceFlag{
 			Name:  "tag",
@@ -54,6 +58,52 @@ var publishCmd = cli.Command{
 			Name:  "force",
 			Usage: "force publishing the images present in the OCI layout even if they should be rebuilt",
 		},
+		cli.BoolTFlag{
+			Name:  "dest-tls-verify",
+			Usage: "verify the destination registry's TLS certificate",
+		},
+		cli.BoolFlag{
+			Name:  "multi-arch",
+			Usage: "publish layers that share a publish name as one multi-platform image index",
+		},
+		cli.StringFlag{
+			Name:  "cert-dir",
+			Usage: "directory with the CA certificates (*.crt) and client certificates (*.cert, *.key) for the destination registry",
+		},
+		cli.StringFlag{
+			Name:  "sign-key",
+			Usage: "PEM encoded private key to sign the published images with (encrypted cosign keys use $COSIGN_PASSWORD)",
+		},
+		cli.StringFlag{
+			Name:  "digest-file",
+			Usage: "file to write the digest of each published image to, as JSON",
+		},
+		cli.StringFlag{
+			Name:  "name-template",
+			Usage: "template for the name to publish each layer as, e.g. 'team/{{.Layer}}'",
+		},
+		cli.StringFlag{
+			Name:  "tag-template",
+			Usage: "template for the tags to publish each layer with, rendered for each --tag, e.g. '{{.GitVersion}}-{{.Tag}}'",
+		},
+		cli.StringSliceFlag{
+			Name:  "layer",
+			Usage: "only publish layers whose names match this glob (can be given more than once)",
+		},
+		cli.IntFlag{
+			Name:  "jobs",
+			Usage: "how many images to publish to a registry at once",
+			Value: 1,
+		},
+		cli.IntFlag{
+			Name:  "retries",
+			Usage: "how many times to retry publishing an image, with exponential backoff",
+			Value: 2,
+		},
+		cli.StringFlag{
+			Name:  "layer-type",
+			Usage: "convert the published images' layers to this type (supported values: tar, squashfs), rather than publishing them as they were built",
+		},
 	},
 	Before: beforePublish,
 }
@@ -72,7 +122,14 @@ func beforePublish(ctx *cli.Context) error {
 
 	username := ctx.String("username")
 	password := ctx.String("password")
-	if (username == "") != (password == "") {
+	if ctx.Bool("password-stdin") {
+		if username == "" {
+			return errors.Errorf("--password-stdin needs --username")
+		}
+		if password != "" {
+			return errors.Errorf("--password and --password-stdin don't make sense together")
+		}
+	} else if (username == "") != (password == "") {
 		return errors.Errorf("supply both username and password, or none of them, current values: '%s' '%s'",
 			username,
 			password)
@@ -82,10 +139,21 @@ func beforePublish(ctx *cli.Context) error {
 		return errors.Errorf("--url is a mandatory argument for publishing")
 	}
 
+	if ctx.String("layer-type") != "" {
+		if err := validateLayerTypeFlags(ctx); err != nil {
+			return err
+		}
+	}
+
 	return nil
 }
 
 func doPublish(ctx *cli.Context) error {
+	password, err := readPassword(ctx)
+	if err != nil {
+		return err
+	}
+
 	args := stacker.PublishArgs{
 		Config:     config,
 		ShowOnly:   ctx.Bool("show-only"),
@@ -93,13 +161,26 @@ func doPublish(ctx *cli.Context) error {
 		Tags:       ctx.StringSlice("tag"),
 		Url:        ctx.String("url"),
 		Username:   ctx.String("username"),
-		Password:   ctx.String("password"),
+		Password:   password,
 		Force:      ctx.Bool("force"),
 		Progress:   shouldShowProgress(ctx),
+		TLSVerify:  ctx.BoolT("dest-tls-verify"),
+		CertDir:    ctx.String("cert-dir"),
+		MultiArch:  ctx.Bool("multi-arch"),
+		SignKey:    ctx.String("sign-key"),
+		DigestFile: ctx.String("digest-file"),
+
+		NameTemplate: ctx.String("name-template"),
+		TagTemplate:  ctx.String("tag-template"),
+
+		Layers:  ctx.StringSlice("layer"),
+		Jobs:    ctx.Int("jobs"),
+		Retries: ctx.Int("retries"),
+
+		LayerType: ctx.String("layer-type"),
 	}
 
 	var stackerFiles []string
-	var err error
 	if len(ctx.String("search-dir")) > 0 {
 		// Need to search for all the paths matching the stacker-file regex under search-dir
 		stackerFiles, err = lib.FindFiles(ctx.String("search-dir"), ctx.String("stacker-file-pattern"))
@@ -4,6 +4,7 @@ import (
 	"os"
 	"regexp"
 
+	"github.com/anuvu/stacker/types"
 	"github.com/pkg/errors"
 	"github.com/urfave/cli"
 )
@@ -37,6 +38,10 @@ func validateLayerTypeFlags(ctx *cli.Context) error {
 	return nil
 }
 
+func validatePullPolicyFlags(ctx *cli.Context) error {
+	return types.ValidatePullPolicy(ctx.String("pull"))
+}
+
 func validateFileSearchFlags(ctx *cli.Context) error {
 
 	// Use the current working directory if base search directory is "."
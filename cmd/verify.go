@@ -0,0 +1,92 @@
+package main
+
+import (
+	"context"
+
+	"github.com/anuvu/stacker/lib"
+	"github.com/anuvu/stacker/log"
+	"github.com/opencontainers/umoci"
+	"github.com/pkg/errors"
+	"github.com/urfave/cli"
+)
+
+var verifyCmd = cli.Command{
+	Name:   "verify",
+	Usage:  "verifies the signatures of images in an OCI layout",
+	Action: doVerify,
+	Flags: []cli.Flag{
+		cli.StringFlag{
+			Name:  "key",
+			Usage: "PEM encoded public key to verify the signatures with",
+		},
+		cli.StringFlag{
+			Name:  "layout",
+			Usage: "the OCI layout to verify images in (defaults to stacker's output layout)",
+		},
+	},
+	ArgsUsage: `[tag...]
+
+<tag> is a tag in the layout to verify. If none are supplied, verify checks
+every image in the layout.`,
+}
+
+func doVerify(ctx *cli.Context) error {
+	if ctx.String("key") == "" {
+		return errors.Errorf("--key is a mandatory argument for verify")
+	}
+
+	key, err := lib.LoadVerifyKey(ctx.String("key"))
+	if err != nil {
+		return err
+	}
+
+	layout := ctx.String("layout")
+	if layout == "" {
+		layout = config.OCIDir
+	}
+
+	oci, err := umoci.OpenLayout(layout)
+	if err != nil {
+		return err
+	}
+	defer oci.Close()
+
+	tags := []string(ctx.Args())
+	if len(tags) == 0 {
+		tags, err = oci.ListReferences(context.Background())
+		if err != nil {
+			return err
+		}
+	}
+
+	failed := 0
+	for _, tag := range tags {
+		if lib.IsSignatureTag(tag) {
+			continue
+		}
+
+		descPaths, err := oci.ResolveReference(context.Background(), tag)
+		if err != nil {
+			return err
+		}
+
+		if len(descPaths) == 0 {
+			return errors.Errorf("couldn't find %s in %s", tag, layout)
+		}
+
+		d := descPaths[0].Root().Digest
+		if err := lib.VerifySignature(oci, d, key); err != nil {
+			log.Infof("%s: FAILED: %v", tag, err)
+			failed++
+			continue
+		}
+
+		log.Infof("%s: verified %s", tag, d)
+	}
+
+	if failed > 0 {
+		return errors.Errorf("%d images failed verification", failed)
+	}
+
+	return nil
+}
@@ -9,6 +9,7 @@ require (
 	github.com/containers/image/v5 v5.5.1
 	github.com/containers/libtrust v0.0.0-20200511145503-9c3a6c22cd9a // indirect
 	github.com/containers/ocicrypt v1.0.3 // indirect
+	github.com/containers/storage v1.20.2
 	github.com/dustin/go-humanize v1.0.0
 	github.com/flosch/pongo2 v0.0.0-20200529170236-5abacdfa4915 // indirect
 	github.com/freddierice/go-losetup v0.0.0-20170407175016-fc9adea44124
@@ -171,6 +171,17 @@ func acquireUrl(c types.StackerConfig, i string, cache string, progress bool) (s
 	if url.Scheme == "" {
 		return importFile(i, cache)
 	} else if url.Scheme == "http" || url.Scheme == "https" {
+		if c.Offline {
+			// we can't check if the cached copy is up to date, so
+			// just use whatever we have.
+			cached := path.Join(cache, path.Base(i))
+			if _, err := os.Stat(cached); err != nil {
+				return "", &types.NeedsNetworkError{Missing: []string{i}}
+			}
+			log.Infof("offline, using cached copy of %s", i)
+			return cached, nil
+		}
+
 		// otherwise, we need to download it
 		return Download(cache, i, progress)
 	} else if url.Scheme == "stacker" {
@@ -186,6 +197,13 @@ func CleanImportsDir(c types.StackerConfig, name string, imports []string, cache
 
 	cacheEntry, cacheHit := cache.Cache[name]
 	if !cacheHit {
+		// When offline, whatever is here may be the only copy of
+		// something we downloaded before, so let's keep it around;
+		// Import() will prune anything that isn't imported any more.
+		if c.Offline {
+			return nil
+		}
+
 		// no previous build means we should delete everything that was
 		// imported; who knows where it came from.
 		return os.RemoveAll(dir)
@@ -245,3 +263,34 @@ func Import(c types.StackerConfig, name string, imports []string, progress bool)
 
 	return nil
 }
+
+// ExtractImports unpacks the imports of layer name that are marked with
+// `extract: true` into its rootfs. They must already have been imported via
+// Import().
+func ExtractImports(c types.StackerConfig, name string, imports []types.Import) error {
+	dir := path.Join(c.StackerDir, "imports", name)
+	rootfs := path.Join(c.RootFSDir, name, "rootfs")
+
+	for _, imp := range imports {
+		if !imp.Extract {
+			continue
+		}
+
+		archive := path.Join(dir, path.Base(imp.Path))
+		st, err := os.Stat(archive)
+		if err != nil {
+			return errors.Wrapf(err, "couldn't find import %s", imp.Path)
+		}
+
+		if st.IsDir() {
+			return errors.Errorf("can't extract %s, it is a directory", imp.Path)
+		}
+
+		log.Infof("extracting %s", imp.Path)
+		if err := unpackTar(archive, rootfs); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
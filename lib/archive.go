@@ -0,0 +1,31 @@
+package lib
+
+import (
+	"io"
+	"os"
+
+	"github.com/containers/storage/pkg/archive"
+	"github.com/pkg/errors"
+)
+
+// TarDir writes an uncompressed tarball of the contents of dir to dest, the
+// same way containers/image's oci-archive transport archives an OCI layout.
+func TarDir(dir string, dest string) error {
+	input, err := archive.Tar(dir, archive.Uncompressed)
+	if err != nil {
+		return errors.Wrapf(err, "couldn't archive %s", dir)
+	}
+	defer input.Close()
+
+	f, err := os.Create(dest)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	if _, err := io.Copy(f, input); err != nil {
+		return errors.Wrapf(err, "couldn't write %s", dest)
+	}
+
+	return f.Close()
+}
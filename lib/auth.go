@@ -0,0 +1,109 @@
+package lib
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"os"
+	"os/exec"
+	"strings"
+
+	"github.com/containers/image/v5/docker"
+	"github.com/containers/image/v5/pkg/docker/config"
+	"github.com/containers/image/v5/types"
+	"github.com/pkg/errors"
+)
+
+// CredentialHelperCredentials returns the username and password for registry
+// from the docker credential helper docker-credential-<helper>.
+func CredentialHelperCredentials(helper string, registry string) (string, string, error) {
+	stderr := bytes.Buffer{}
+	cmd := exec.Command("docker-credential-"+helper, "get")
+	cmd.Stdin = strings.NewReader(registry)
+	cmd.Stderr = &stderr
+
+	output, err := cmd.Output()
+	if err != nil {
+		if msg := strings.TrimSpace(stderr.String()); msg != "" {
+			err = errors.Errorf("%v: %s", err, msg)
+		}
+		return "", "", errors.Wrapf(err, "docker-credential-%s couldn't get credentials for %s", helper, registry)
+	}
+
+	creds := struct {
+		Username string
+		Secret   string
+	}{}
+	if err := json.Unmarshal(output, &creds); err != nil {
+		return "", "", errors.Wrapf(err, "bad credentials from docker-credential-%s", helper)
+	}
+
+	return creds.Username, creds.Secret, nil
+}
+
+// LoginOpts are the options for Login.
+type LoginOpts struct {
+	// AuthFile is the auth.json to store the credentials in; if it is
+	// empty, containers/image's default is used.
+	AuthFile string
+
+	Registry string
+	Username string
+	Password string
+
+	// SkipCheck stores the credentials without checking that they work
+	// with the registry.
+	SkipCheck bool
+	SkipTLS   bool
+	CertDir   string
+}
+
+// Login stores credentials for a registry in an auth file, which pulls and
+// publishes then use. If the auth file sets a credHelper for the registry,
+// the credentials are stored with it instead.
+func Login(opts LoginOpts) error {
+	sys := &types.SystemContext{
+		AuthFilePath:   opts.AuthFile,
+		DockerCertPath: opts.CertDir,
+	}
+
+	if opts.SkipTLS {
+		sys.DockerInsecureSkipTLSVerify = types.OptionalBoolTrue
+	}
+
+	if !opts.SkipCheck {
+		err := docker.CheckAuth(context.Background(), sys, opts.Username, opts.Password, opts.Registry)
+		if err != nil {
+			return errors.Wrapf(err, "couldn't log in to %s", opts.Registry)
+		}
+	}
+
+	err := config.SetAuthentication(sys, opts.Registry, opts.Username, opts.Password)
+	if err != nil {
+		return errors.Wrapf(err, "couldn't store credentials for %s", opts.Registry)
+	}
+
+	// containers/image creates auth files world readable
+	if opts.AuthFile != "" {
+		return os.Chmod(opts.AuthFile, 0600)
+	}
+
+	return nil
+}
+
+// Logout removes the credentials for registry from authFile (or the default
+// auth file), or every registry's credentials if registry is empty.
+func Logout(authFile string, registry string) error {
+	sys := &types.SystemContext{AuthFilePath: authFile}
+
+	if registry == "" {
+		return errors.Wrapf(config.RemoveAllAuthentication(sys), "couldn't remove credentials")
+	}
+
+	err := config.RemoveAuthentication(sys, registry)
+	if errors.Cause(err) == config.ErrNotLoggedIn {
+		return errors.Errorf("not logged in to %s", registry)
+	}
+
+	return errors.Wrapf(err, "couldn't remove credentials for %s", registry)
+}
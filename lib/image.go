@@ -7,9 +7,14 @@ import (
 
 	"github.com/containers/image/v5/copy"
 	"github.com/containers/image/v5/docker"
+	dockerarchive "github.com/containers/image/v5/docker/archive"
+	"github.com/containers/image/v5/docker/reference"
+	"github.com/containers/image/v5/manifest"
+	ociarchive "github.com/containers/image/v5/oci/archive"
 	"github.com/containers/image/v5/oci/layout"
 	"github.com/containers/image/v5/signature"
 	"github.com/containers/image/v5/types"
+	"github.com/opencontainers/go-digest"
 	ispec "github.com/opencontainers/image-spec/specs-go/v1"
 	"github.com/opencontainers/umoci"
 	"github.com/pkg/errors"
@@ -29,6 +34,8 @@ func init() {
 	urlSchemes = map[string]func(string) (types.ImageReference, error){}
 	RegisterURLScheme("oci", layout.ParseReference)
 	RegisterURLScheme("docker", docker.ParseReference)
+	RegisterURLScheme("oci-archive", ociarchive.ParseReference)
+	RegisterURLScheme("docker-archive", dockerarchive.ParseReference)
 }
 
 func localRefParser(ref string) (types.ImageReference, error) {
@@ -45,6 +52,32 @@ func localRefParser(ref string) (types.ImageReference, error) {
 	return f(parts[1])
 }
 
+// ManifestDigest returns the digest of the manifest that opts.Src currently
+// refers to, without copying anything. For registries, this is the digest
+// that would be used to pin the image, i.e. docker://image@sha256:... Only
+// the source options in opts are used.
+func ManifestDigest(opts ImageCopyOpts) (digest.Digest, error) {
+	ctx := context.Background()
+
+	srcRef, err := localRefParser(opts.Src)
+	if err != nil {
+		return "", err
+	}
+
+	src, err := srcRef.NewImageSource(ctx, opts.sourceCtx())
+	if err != nil {
+		return "", err
+	}
+	defer src.Close()
+
+	raw, _, err := src.GetManifest(ctx, nil)
+	if err != nil {
+		return "", errors.Wrapf(err, "couldn't get manifest for %s", opts.Src)
+	}
+
+	return manifest.Digest(raw)
+}
+
 type ImageCopyOpts struct {
 	Src          string
 	Dest         string
@@ -53,43 +86,197 @@ type ImageCopyOpts struct {
 	SkipTLS      bool
 	Progress     io.Writer
 	Context      context.Context
+
+	// SrcUsername and SrcPassword are explicit credentials for the
+	// source registry. If they're not set, containers/image looks in
+	// SrcAuthFile (or the default auth.json), ~/.docker/config.json, and
+	// any credential helpers configured there.
+	SrcUsername string
+	SrcPassword string
+	SrcAuthFile string
+
+	// SrcCertDir is a directory containing the CA certs (*.crt) and
+	// client certs (*.cert, *.key) to talk to the source registry with.
+	SrcCertDir string
+
+	// RegistriesConf is the registries.conf used to resolve mirrors for
+	// the source.
+	RegistriesConf string
+
+	// DestSkipTLS disables TLS verification for the destination
+	// registry, and DestCertDir is the destination's equivalent of
+	// SrcCertDir.
+	DestSkipTLS bool
+	DestCertDir string
+
+	// DestAuthFile is the destination's equivalent of SrcAuthFile.
+	DestAuthFile string
+
+	// DestAdditionalTags are more name:tag references to write the image
+	// with if Dest is a docker-archive.
+	DestAdditionalTags []string
+
+	// PolicyPath is a containers-policy.json(5) that the source image
+	// must satisfy. If it is empty, any image is accepted.
+	PolicyPath string
+
+	// AllImages copies every image in Src if it is an image index,
+	// rather than just the one for the host's platform.
+	AllImages bool
+
+	// SrcPlatform is the platform of the image to copy if Src is an image
+	// index. If it is nil, the host's platform is used.
+	SrcPlatform *ispec.Platform
+}
+
+func (opts ImageCopyOpts) sourceCtx() *types.SystemContext {
+	sys := &types.SystemContext{
+		AuthFilePath:             opts.SrcAuthFile,
+		DockerCertPath:           opts.SrcCertDir,
+		SystemRegistriesConfPath: opts.RegistriesConf,
+	}
+
+	if opts.SkipTLS {
+		sys.DockerInsecureSkipTLSVerify = types.OptionalBoolTrue
+	}
+
+	if opts.SrcUsername != "" {
+		sys.DockerAuthConfig = &types.DockerAuthConfig{
+			Username: opts.SrcUsername,
+			Password: opts.SrcPassword,
+		}
+	}
+
+	if opts.SrcPlatform != nil {
+		sys.OSChoice = opts.SrcPlatform.OS
+		sys.ArchitectureChoice = opts.SrcPlatform.Architecture
+		sys.VariantChoice = opts.SrcPlatform.Variant
+	}
+
+	return sys
 }
 
 func ImageCopy(opts ImageCopyOpts) error {
+	_, _, err := imageCopy(opts)
+	return err
+}
+
+// ImageCopyDigest is ImageCopy, but also returns the digest of the manifest
+// (or image index) written to Dest.
+func ImageCopyDigest(opts ImageCopyOpts) (digest.Digest, error) {
+	_, d, err := imageCopy(opts)
+	return d, err
+}
+
+// ImageCopySourceDigest is ImageCopy, but also returns the digest of the
+// manifest (or image index) read from Src. That may not be the digest written
+// to Dest, since containers/image may convert the manifest as it copies it.
+func ImageCopySourceDigest(opts ImageCopyOpts) (digest.Digest, error) {
+	d, _, err := imageCopy(opts)
+	return d, err
+}
+
+// digestRecordingReference is a source reference that records the digest of
+// the (top level) manifest that is read from it.
+type digestRecordingReference struct {
+	types.ImageReference
+	digest *digest.Digest
+}
+
+func (r digestRecordingReference) NewImageSource(ctx context.Context, sys *types.SystemContext) (types.ImageSource, error) {
+	src, err := r.ImageReference.NewImageSource(ctx, sys)
+	if err != nil {
+		return nil, err
+	}
+
+	return digestRecordingSource{src, r.digest}, nil
+}
+
+type digestRecordingSource struct {
+	types.ImageSource
+	digest *digest.Digest
+}
+
+func (s digestRecordingSource) GetManifest(ctx context.Context, instanceDigest *digest.Digest) ([]byte, string, error) {
+	raw, mediaType, err := s.ImageSource.GetManifest(ctx, instanceDigest)
+	if err != nil || instanceDigest != nil {
+		return raw, mediaType, err
+	}
+
+	*s.digest, err = manifest.Digest(raw)
+	return raw, mediaType, err
+}
+
+// imageCopy copies opts.Src to opts.Dest, and returns the digests of the
+// manifest read from Src and written to Dest.
+func imageCopy(opts ImageCopyOpts) (digest.Digest, digest.Digest, error) {
 	if opts.Context == nil {
 		opts.Context = context.Background()
 	}
 
-	srcRef, err := localRefParser(opts.Src)
+	ref, err := localRefParser(opts.Src)
 	if err != nil {
-		return err
+		return "", "", err
 	}
 
+	var sourceDigest digest.Digest
+	srcRef := digestRecordingReference{ref, &sourceDigest}
+
 	destRef, err := localRefParser(opts.Dest)
 	if err != nil {
-		return err
+		return "", "", err
 	}
 
-	policy, err := signature.NewPolicyContext(&signature.Policy{
+	policy := &signature.Policy{
 		Default: []signature.PolicyRequirement{
 			signature.NewPRInsecureAcceptAnything(),
 		},
-	})
+	}
+
+	if opts.PolicyPath != "" {
+		policy, err = signature.NewPolicyFromFile(opts.PolicyPath)
+		if err != nil {
+			return "", "", errors.Wrapf(err, "couldn't read signature policy %s", opts.PolicyPath)
+		}
+	}
+
+	policyContext, err := signature.NewPolicyContext(policy)
 	if err != nil {
-		return err
+		return "", "", err
 	}
+	defer policyContext.Destroy()
 
 	args := &copy.Options{
 		ReportWriter: opts.Progress,
+		SourceCtx:    opts.sourceCtx(),
 	}
 
-	if opts.SkipTLS {
-		args.SourceCtx = &types.SystemContext{
-			DockerInsecureSkipTLSVerify: types.OptionalBoolTrue,
-		}
+	if opts.AllImages {
+		args.ImageListSelection = copy.CopyAllImages
 	}
 
-	args.DestinationCtx = &types.SystemContext{}
+	args.DestinationCtx = &types.SystemContext{
+		AuthFilePath:   opts.DestAuthFile,
+		DockerCertPath: opts.DestCertDir,
+	}
+
+	if opts.DestSkipTLS {
+		args.DestinationCtx.DockerInsecureSkipTLSVerify = types.OptionalBoolTrue
+	}
+
+	for _, tag := range opts.DestAdditionalTags {
+		named, err := reference.ParseNormalizedNamed(tag)
+		if err != nil {
+			return "", "", errors.Wrapf(err, "couldn't parse %s", tag)
+		}
+
+		tagged, ok := named.(reference.NamedTagged)
+		if !ok {
+			return "", "", errors.Errorf("%s has no tag", tag)
+		}
+
+		args.DestinationCtx.DockerArchiveAdditionalTags = append(args.DestinationCtx.DockerArchiveAdditionalTags, tagged)
+	}
 
 	if opts.DestUsername != "" {
 		args.DestinationCtx.DockerAuthConfig = &types.DockerAuthConfig{
@@ -98,9 +285,17 @@ func ImageCopy(opts ImageCopyOpts) error {
 		}
 	}
 
-	_, err = copy.Image(opts.Context, policy, destRef, srcRef, args)
+	copied, err := copy.Image(opts.Context, policyContext, destRef, srcRef, args)
+	if err != nil {
+		if _, ok := errors.Cause(err).(signature.PolicyRequirementError); ok {
+			return "", "", errors.Errorf("%s rejected by signature policy %s: %v", opts.Src, opts.PolicyPath, errors.Cause(err))
+		}
+		return "", "", err
+	}
+
+	manifestDigest, err := manifest.Digest(copied)
 	if err != nil {
-		return err
+		return "", "", err
 	}
 
 	// containers/image OCI as of
@@ -123,18 +318,18 @@ func ImageCopy(opts ImageCopyOpts) error {
 		// oci:$path:$tag
 		parts := strings.SplitN(opts.Dest, ":", 3)
 		if len(parts) != 3 {
-			return errors.Errorf("un-parsable oci dest %s", opts.Dest)
+			return "", "", errors.Errorf("un-parsable oci dest %s", opts.Dest)
 		}
 
 		oci, err := umoci.OpenLayout(parts[1])
 		if err != nil {
-			return err
+			return "", "", err
 		}
 		defer oci.Close()
 
 		index, err := oci.GetIndex(opts.Context)
 		if err != nil {
-			return err
+			return "", "", err
 		}
 
 		newIndex := []ispec.Descriptor{}
@@ -150,9 +345,9 @@ func ImageCopy(opts ImageCopyOpts) error {
 		index.Manifests = newIndex
 		err = oci.PutIndex(opts.Context, index)
 		if err != nil {
-			return err
+			return "", "", err
 		}
 	}
 
-	return nil
+	return sourceDigest, manifestDigest, nil
 }
@@ -103,3 +103,38 @@ func TestOldManifestReallyRemoved(t *testing.T) {
 	assert.NoError(err)
 	assert.Len(index.Manifests, 1)
 }
+
+func TestImageCopySignaturePolicy(t *testing.T) {
+	assert := assert.New(t)
+	dir, err := ioutil.TempDir("", "stacker-signature-policy-test")
+	assert.NoError(err)
+	defer os.RemoveAll(dir)
+
+	oci, err := umoci.CreateLayout(path.Join(dir, "oci"))
+	assert.NoError(err)
+	assert.NoError(umoci.NewImage(oci, "foo"))
+	oci.Close()
+
+	reject := path.Join(dir, "reject.json")
+	assert.NoError(ioutil.WriteFile(reject, []byte(`{"default": [{"type": "reject"}]}`), 0644))
+
+	err = ImageCopy(ImageCopyOpts{
+		Src:        fmt.Sprintf("oci:%s/oci:foo", dir),
+		Dest:       fmt.Sprintf("oci:%s/oci2:foo", dir),
+		PolicyPath: reject,
+	})
+	assert.Error(err)
+	assert.Contains(err.Error(), fmt.Sprintf("oci:%s/oci:foo rejected by signature policy %s", dir, reject))
+
+	accept := path.Join(dir, "accept.json")
+	assert.NoError(ioutil.WriteFile(accept, []byte(`{
+	"default": [{"type": "reject"}],
+	"transports": {"oci": {"": [{"type": "insecureAcceptAnything"}]}}
+}`), 0644))
+
+	assert.NoError(ImageCopy(ImageCopyOpts{
+		Src:        fmt.Sprintf("oci:%s/oci:foo", dir),
+		Dest:       fmt.Sprintf("oci:%s/oci2:foo", dir),
+		PolicyPath: accept,
+	}))
+}
@@ -0,0 +1,344 @@
+package lib
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"strings"
+
+	"github.com/opencontainers/go-digest"
+	"github.com/opencontainers/image-spec/specs-go"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/opencontainers/umoci/oci/casext"
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/nacl/secretbox"
+	"golang.org/x/crypto/scrypt"
+)
+
+// Signatures are stored the way cosign stores them: as an image tagged
+// sha256-<manifest digest>.sig, whose layers are simple signing payloads
+// annotated with their signature. This means `cosign verify --key` can check
+// images stacker signed, and vice versa.
+const (
+	cosignPayloadMediaType    = "application/vnd.dev.cosign.simplesigning.v1+json"
+	cosignSignatureAnnotation = "dev.cosignproject.cosign/signature"
+	cosignSignatureType       = "cosign container image signature"
+)
+
+type simpleSigningPayload struct {
+	Critical struct {
+		Identity struct {
+			DockerReference string `json:"docker-reference"`
+		} `json:"identity"`
+		Image struct {
+			DockerManifestDigest string `json:"docker-manifest-digest"`
+		} `json:"image"`
+		Type string `json:"type"`
+	} `json:"critical"`
+	Optional map[string]interface{} `json:"optional"`
+}
+
+// SignatureTag returns the tag the signature of the manifest with digest d is
+// stored under.
+func SignatureTag(d digest.Digest) string {
+	return fmt.Sprintf("%s-%s.sig", d.Algorithm(), d.Encoded())
+}
+
+// IsSignatureTag returns true if tag is where a signature is stored, rather
+// than an image.
+func IsSignatureTag(tag string) bool {
+	return strings.HasPrefix(tag, "sha256-") && strings.HasSuffix(tag, ".sig")
+}
+
+// cosignEncryptedKey is the (PEM decoded) content of a private key generated
+// by cosign generate-key-pair.
+type cosignEncryptedKey struct {
+	KDF struct {
+		Name   string `json:"name"`
+		Params struct {
+			N int `json:"N"`
+			R int `json:"r"`
+			P int `json:"p"`
+		} `json:"params"`
+		Salt []byte `json:"salt"`
+	} `json:"kdf"`
+	Cipher struct {
+		Name  string `json:"name"`
+		Nonce []byte `json:"nonce"`
+	} `json:"cipher"`
+	Ciphertext []byte `json:"ciphertext"`
+}
+
+func decryptCosignKey(content []byte, password string) ([]byte, error) {
+	encrypted := cosignEncryptedKey{}
+	if err := json.Unmarshal(content, &encrypted); err != nil {
+		return nil, errors.Wrapf(err, "bad encrypted key")
+	}
+
+	if encrypted.KDF.Name != "scrypt" || encrypted.Cipher.Name != "nacl/secretbox" {
+		return nil, errors.Errorf("unsupported key encryption %s/%s", encrypted.KDF.Name, encrypted.Cipher.Name)
+	}
+
+	params := encrypted.KDF.Params
+	derived, err := scrypt.Key([]byte(password), encrypted.KDF.Salt, params.N, params.R, params.P, 32)
+	if err != nil {
+		return nil, err
+	}
+
+	var key [32]byte
+	var nonce [24]byte
+	copy(key[:], derived)
+	copy(nonce[:], encrypted.Cipher.Nonce)
+
+	decrypted, ok := secretbox.Open(nil, encrypted.Ciphertext, &nonce, &key)
+	if !ok {
+		return nil, errors.Errorf("couldn't decrypt key, is COSIGN_PASSWORD right?")
+	}
+
+	return decrypted, nil
+}
+
+// LoadSigningKey reads the PEM encoded ECDSA or RSA private key in path. The
+// key may be encrypted as cosign generate-key-pair does, in which case its
+// password is taken from $COSIGN_PASSWORD.
+func LoadSigningKey(path string) (crypto.Signer, error) {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	block, _ := pem.Decode(content)
+	if block == nil {
+		return nil, errors.Errorf("%s isn't a PEM encoded private key", path)
+	}
+
+	var key interface{}
+	switch block.Type {
+	case "EC PRIVATE KEY":
+		key, err = x509.ParseECPrivateKey(block.Bytes)
+	case "RSA PRIVATE KEY":
+		key, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+	case "PRIVATE KEY":
+		key, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+	case "ENCRYPTED COSIGN PRIVATE KEY", "ENCRYPTED SIGSTORE PRIVATE KEY":
+		var der []byte
+		der, err = decryptCosignKey(block.Bytes, os.Getenv("COSIGN_PASSWORD"))
+		if err == nil {
+			key, err = x509.ParsePKCS8PrivateKey(der)
+		}
+	default:
+		return nil, errors.Errorf("%s has unsupported key type %s", path, block.Type)
+	}
+	if err != nil {
+		return nil, errors.Wrapf(err, "couldn't read private key %s", path)
+	}
+
+	switch key := key.(type) {
+	case *ecdsa.PrivateKey:
+		return key, nil
+	case *rsa.PrivateKey:
+		return key, nil
+	default:
+		return nil, errors.Errorf("%s isn't an ECDSA or RSA key", path)
+	}
+}
+
+// LoadVerifyKey reads the PEM encoded ECDSA or RSA public key in path.
+func LoadVerifyKey(path string) (crypto.PublicKey, error) {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	block, _ := pem.Decode(content)
+	if block == nil || block.Type != "PUBLIC KEY" {
+		return nil, errors.Errorf("%s isn't a PEM encoded public key", path)
+	}
+
+	key, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, errors.Wrapf(err, "couldn't read public key %s", path)
+	}
+
+	switch key.(type) {
+	case *ecdsa.PublicKey, *rsa.PublicKey:
+		return key, nil
+	default:
+		return nil, errors.Errorf("%s isn't an ECDSA or RSA key", path)
+	}
+}
+
+// WriteSignature signs the manifest with digest d, known as ref (i.e. the
+// repository it is published to), and stores the signature in oci under tag.
+func WriteSignature(oci casext.Engine, tag string, ref string, d digest.Digest, key crypto.Signer) error {
+	ctx := context.Background()
+
+	payload := simpleSigningPayload{}
+	payload.Critical.Identity.DockerReference = ref
+	payload.Critical.Image.DockerManifestDigest = d.String()
+	payload.Critical.Type = cosignSignatureType
+
+	content, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+
+	hash := sha256.Sum256(content)
+	sig, err := key.Sign(rand.Reader, hash[:], crypto.SHA256)
+	if err != nil {
+		return errors.Wrapf(err, "couldn't sign %s", d)
+	}
+
+	payloadDigest, payloadSize, err := oci.PutBlob(ctx, bytes.NewReader(content))
+	if err != nil {
+		return err
+	}
+
+	config := ispec.Image{
+		RootFS: ispec.RootFS{
+			Type:    "layers",
+			DiffIDs: []digest.Digest{payloadDigest},
+		},
+	}
+
+	configDigest, configSize, err := oci.PutBlobJSON(ctx, config)
+	if err != nil {
+		return err
+	}
+
+	manifest := ispec.Manifest{
+		Versioned: specs.Versioned{SchemaVersion: 2},
+		Config: ispec.Descriptor{
+			MediaType: ispec.MediaTypeImageConfig,
+			Digest:    configDigest,
+			Size:      configSize,
+		},
+		Layers: []ispec.Descriptor{{
+			MediaType: cosignPayloadMediaType,
+			Digest:    payloadDigest,
+			Size:      payloadSize,
+			Annotations: map[string]string{
+				cosignSignatureAnnotation: base64.StdEncoding.EncodeToString(sig),
+			},
+		}},
+	}
+
+	manifestDigest, manifestSize, err := oci.PutBlobJSON(ctx, manifest)
+	if err != nil {
+		return err
+	}
+
+	return oci.UpdateReference(ctx, tag, ispec.Descriptor{
+		MediaType: ispec.MediaTypeImageManifest,
+		Digest:    manifestDigest,
+		Size:      manifestSize,
+	})
+}
+
+// VerifySignature checks that oci has a signature of the manifest with
+// digest d made with the private half of key.
+func VerifySignature(oci casext.Engine, d digest.Digest, key crypto.PublicKey) error {
+	ctx := context.Background()
+
+	descPaths, err := oci.ResolveReference(ctx, SignatureTag(d))
+	if err != nil {
+		return err
+	}
+
+	if len(descPaths) != 1 {
+		return errors.Errorf("no signature for %s", d)
+	}
+
+	blob, err := oci.FromDescriptor(ctx, descPaths[0].Descriptor())
+	if err != nil {
+		return err
+	}
+	defer blob.Close()
+
+	manifest, ok := blob.Data.(ispec.Manifest)
+	if !ok {
+		return errors.Errorf("signature of %s isn't an image manifest", d)
+	}
+
+	err = errors.Errorf("no signatures for %s in %s", d, SignatureTag(d))
+	for _, layer := range manifest.Layers {
+		if layer.MediaType != cosignPayloadMediaType {
+			continue
+		}
+
+		err = verifyPayload(oci, layer, d, key)
+		if err == nil {
+			return nil
+		}
+	}
+
+	return err
+}
+
+func verifyPayload(oci casext.Engine, layer ispec.Descriptor, d digest.Digest, key crypto.PublicKey) error {
+	reader, err := oci.GetBlob(context.Background(), layer.Digest)
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+
+	content, err := ioutil.ReadAll(reader)
+	if err != nil {
+		return err
+	}
+
+	if digest.FromBytes(content) != layer.Digest {
+		return errors.Errorf("signature payload %s is corrupt", layer.Digest)
+	}
+
+	sig, err := base64.StdEncoding.DecodeString(layer.Annotations[cosignSignatureAnnotation])
+	if err != nil {
+		return errors.Wrapf(err, "bad signature for %s", d)
+	}
+
+	hash := sha256.Sum256(content)
+	switch key := key.(type) {
+	case *ecdsa.PublicKey:
+		var rs struct{ R, S *big.Int }
+		if _, err := asn1.Unmarshal(sig, &rs); err != nil {
+			return errors.Wrapf(err, "bad signature for %s", d)
+		}
+		if !ecdsa.Verify(key, hash[:], rs.R, rs.S) {
+			return errors.Errorf("signature for %s doesn't match the key", d)
+		}
+	case *rsa.PublicKey:
+		if err := rsa.VerifyPKCS1v15(key, crypto.SHA256, hash[:], sig); err != nil {
+			return errors.Errorf("signature for %s doesn't match the key", d)
+		}
+	default:
+		return errors.Errorf("unsupported key type %T", key)
+	}
+
+	payload := simpleSigningPayload{}
+	if err := json.Unmarshal(content, &payload); err != nil {
+		return errors.Wrapf(err, "bad signature payload for %s", d)
+	}
+
+	if payload.Critical.Type != cosignSignatureType {
+		return errors.Errorf("unknown signature type %s for %s", payload.Critical.Type, d)
+	}
+
+	if payload.Critical.Image.DockerManifestDigest != d.String() {
+		return errors.Errorf("signature is for %s, not %s", payload.Critical.Image.DockerManifestDigest, d)
+	}
+
+	return nil
+}
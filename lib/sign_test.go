@@ -0,0 +1,85 @@
+package lib
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/opencontainers/umoci"
+	"github.com/stretchr/testify/assert"
+)
+
+func writeKeyPair(t *testing.T, dir string, name string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NoError(t, err)
+
+	der, err := x509.MarshalECPrivateKey(key)
+	assert.NoError(t, err)
+	content := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der})
+	assert.NoError(t, ioutil.WriteFile(path.Join(dir, name), content, 0600))
+
+	der, err = x509.MarshalPKIXPublicKey(&key.PublicKey)
+	assert.NoError(t, err)
+	content = pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der})
+	assert.NoError(t, ioutil.WriteFile(path.Join(dir, name+".pub"), content, 0644))
+}
+
+func TestSignatures(t *testing.T) {
+	assert := assert.New(t)
+	dir, err := ioutil.TempDir("", "stacker-signature-test")
+	assert.NoError(err)
+	defer os.RemoveAll(dir)
+
+	writeKeyPair(t, dir, "key")
+	writeKeyPair(t, dir, "other")
+
+	oci, err := umoci.CreateLayout(path.Join(dir, "oci"))
+	assert.NoError(err)
+	assert.NoError(umoci.NewImage(oci, "foo"))
+	oci.Close()
+
+	d, err := ImageCopyDigest(ImageCopyOpts{
+		Src:  fmt.Sprintf("oci:%s/oci:foo", dir),
+		Dest: fmt.Sprintf("oci:%s/dest:foo", dir),
+	})
+	assert.NoError(err)
+
+	signer, err := LoadSigningKey(path.Join(dir, "key"))
+	assert.NoError(err)
+
+	sigs, err := umoci.CreateLayout(path.Join(dir, "sigs"))
+	assert.NoError(err)
+	assert.NoError(WriteSignature(sigs, "signature", "foo", d, signer))
+	sigs.Close()
+
+	assert.NoError(ImageCopy(ImageCopyOpts{
+		Src:  fmt.Sprintf("oci:%s/sigs:signature", dir),
+		Dest: fmt.Sprintf("oci:%s/dest:%s", dir, SignatureTag(d)),
+	}))
+
+	dest, err := umoci.OpenLayout(path.Join(dir, "dest"))
+	assert.NoError(err)
+	defer dest.Close()
+
+	key, err := LoadVerifyKey(path.Join(dir, "key.pub"))
+	assert.NoError(err)
+	assert.NoError(VerifySignature(dest, d, key))
+
+	other, err := LoadVerifyKey(path.Join(dir, "other.pub"))
+	assert.NoError(err)
+	assert.Error(VerifySignature(dest, d, other))
+
+	// the signature itself isn't signed
+	sigDescs, err := dest.ResolveReference(context.Background(), SignatureTag(d))
+	assert.NoError(err)
+	assert.Len(sigDescs, 1)
+	assert.Error(VerifySignature(dest, sigDescs[0].Descriptor().Digest, key))
+}
@@ -0,0 +1,283 @@
+package stacker
+
+import (
+	"path"
+
+	"github.com/anuvu/stacker/lib"
+	"github.com/anuvu/stacker/log"
+	"github.com/anuvu/stacker/types"
+	"github.com/opencontainers/go-digest"
+	"github.com/pkg/errors"
+)
+
+// lockChecker verifies that the inputs a build actually used match the ones
+// recorded in a stackerfile's lockfile. A nil *lockChecker checks nothing,
+// so callers don't have to care whether there is a lockfile or not.
+type lockChecker struct {
+	path    string
+	lock    *types.Lockfile
+	update  bool
+	changed bool
+}
+
+// newLockChecker returns a lockChecker for sf, or nil if sf has no lockfile
+// and we weren't asked to create one.
+func newLockChecker(sf *types.Stackerfile, update bool) (*lockChecker, error) {
+	p := sf.LockfilePath()
+	if p == "" {
+		return nil, nil
+	}
+
+	lock, exists, err := types.ReadLockfile(p)
+	if err != nil {
+		return nil, err
+	}
+
+	if !exists && !update {
+		return nil, nil
+	}
+
+	return &lockChecker{path: p, lock: lock, update: update}, nil
+}
+
+func (lc *lockChecker) check(entries map[string]string, input string, current string) error {
+	locked, ok := entries[input]
+	if ok && locked == current {
+		return nil
+	}
+
+	if !lc.update {
+		if !ok {
+			return errors.Errorf("%s is not in %s, use --update-lock to add it", input, lc.path)
+		}
+		return errors.Errorf("%s drifted from %s to %s (locked in %s), use --update-lock to accept it", input, locked, current, lc.path)
+	}
+
+	log.Infof("updating %s to %s in %s", input, current, lc.path)
+	entries[input] = current
+	lc.changed = true
+	return nil
+}
+
+// lockedDigest returns the digest is is locked to, if any, so that it can be
+// pulled by digest rather than by a tag that may have moved since it was
+// locked. With --update-lock nothing is locked: the tag is pulled, and the
+// lock updated to whatever it is now.
+func (lc *lockChecker) lockedDigest(is *types.ImageSource) (digest.Digest, error) {
+	if lc == nil || lc.update || is.Type != types.DockerLayer {
+		return "", nil
+	}
+
+	url, err := is.ContainersImageURL()
+	if err != nil {
+		return "", err
+	}
+
+	locked, ok := lc.lock.Images[url]
+	if !ok {
+		return "", nil
+	}
+
+	d, err := digest.Parse(locked)
+	if err != nil {
+		return "", errors.Wrapf(err, "bad digest for %s in %s", url, lc.path)
+	}
+
+	return d, nil
+}
+
+// checkImage checks the manifest digest of the cached copy of is against the
+// lock; local images aren't locked.
+func (lc *lockChecker) checkImage(config types.StackerConfig, is *types.ImageSource) error {
+	if lc == nil || isLocalImage(is) {
+		return nil
+	}
+
+	url, err := is.ContainersImageURL()
+	if err != nil {
+		return err
+	}
+
+	tag, err := is.ParseTag()
+	if err != nil {
+		return err
+	}
+
+	current, err := cachedSourceDigest(path.Join(config.StackerDir, "layer-bases", "oci"), tag)
+	if err != nil {
+		return err
+	}
+
+	if current == "" {
+		return errors.Errorf("the cached copy of %s has no recorded digest, re-pull it with --pull always", url)
+	}
+
+	return lc.check(lc.lock.Images, url, current)
+}
+
+// checkImport checks the content hash of a downloaded file against the lock;
+// local files aren't locked.
+func (lc *lockChecker) checkImport(url string, diskPath string) error {
+	if lc == nil {
+		return nil
+	}
+
+	isHttp, err := isHttpUrl(url)
+	if err != nil {
+		return err
+	}
+
+	if !isHttp {
+		return nil
+	}
+
+	current, err := lib.HashFile(diskPath, false)
+	if err != nil {
+		return err
+	}
+
+	return lc.check(lc.lock.Imports, url, current)
+}
+
+// persist writes the lockfile back out if it was updated.
+func (lc *lockChecker) persist() error {
+	if lc == nil || !lc.changed {
+		return nil
+	}
+
+	lc.changed = false
+	return lc.lock.Write(lc.path)
+}
+
+type LockArgs struct {
+	Config     types.StackerConfig
+	Substitute []string
+	Progress   bool
+}
+
+// Lock resolves the network inputs of the stackerfiles in paths (and their
+// prerequisites) and writes a lockfile next to each of them.
+func Lock(opts LockArgs, paths []string) error {
+	sfm, err := types.NewStackerFiles(paths, append(opts.Substitute, opts.Config.Substitutions()...), opts.Config)
+	if err != nil {
+		return err
+	}
+
+	for _, sf := range sfm {
+		p := sf.LockfilePath()
+		if p == "" {
+			log.Infof("not locking downloaded stackerfile")
+			continue
+		}
+
+		lock := types.NewLockfile()
+
+		lockImage := func(is *types.ImageSource) error {
+			if isLocalImage(is) {
+				return nil
+			}
+
+			candidates, err := sourceCandidates(is, opts.Config, "")
+			if err != nil {
+				return err
+			}
+
+			// the lock is keyed by the url builds look it up by, even if
+			// we resolve it via a mirror or by digest
+			url, err := is.ContainersImageURL()
+			if err != nil {
+				return err
+			}
+
+			for i, copyOpts := range candidates {
+				d, err := lib.ManifestDigest(copyOpts)
+				if err != nil {
+					if i == len(candidates)-1 {
+						return err
+					}
+
+					log.Infof("couldn't resolve %s from mirror, trying the next source: %v", url, err)
+					continue
+				}
+
+				lock.Images[url] = d.String()
+				break
+			}
+
+			return nil
+		}
+
+		lockImport := func(url string, cacheDir string) error {
+			isHttp, err := isHttpUrl(url)
+			if err != nil {
+				return err
+			}
+
+			if !isHttp {
+				return nil
+			}
+
+			diskPath, err := acquireUrl(opts.Config, url, cacheDir, opts.Progress)
+			if err != nil {
+				return err
+			}
+
+			lock.Imports[url], err = lib.HashFile(diskPath, false)
+			return err
+		}
+
+		for _, name := range sf.FileOrder {
+			l, ok := sf.Get(name)
+			if !ok {
+				return errors.Errorf("%s not present in stackerfile?", name)
+			}
+
+			switch l.From.Type {
+			case types.DockerLayer, types.OCILayer, types.ContainersStorageLayer:
+				if err := lockImage(l.From); err != nil {
+					return err
+				}
+			case types.TarLayer, types.SquashfsLayer:
+				err := lockImport(l.From.Url, path.Join(opts.Config.StackerDir, "layer-bases"))
+				if err != nil {
+					return err
+				}
+			}
+
+			applies, err := l.ParseApply()
+			if err != nil {
+				return err
+			}
+
+			for _, is := range applies {
+				// layers from this build aren't network inputs
+				if is.Type == types.BuiltLayer {
+					continue
+				}
+
+				if err := lockImage(is); err != nil {
+					return err
+				}
+			}
+
+			imports, err := l.ParseImport()
+			if err != nil {
+				return err
+			}
+
+			for _, imp := range imports {
+				err := lockImport(imp, path.Join(opts.Config.StackerDir, "imports", name))
+				if err != nil {
+					return err
+				}
+			}
+		}
+
+		log.Infof("writing %s", p)
+		if err := lock.Write(p); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,307 @@
+package stacker
+
+import (
+	"context"
+	"os"
+	"path"
+	"sort"
+
+	"github.com/anuvu/stacker/log"
+	"github.com/anuvu/stacker/types"
+	"github.com/opencontainers/go-digest"
+	"github.com/opencontainers/umoci"
+	"github.com/pkg/errors"
+)
+
+// hasCachedBase returns true if the layer-bases OCI cache in cacheDir has a
+// copy of is.
+func hasCachedBase(cacheDir string, is *types.ImageSource) (bool, error) {
+	tag, err := is.ParseTag()
+	if err != nil {
+		return false, err
+	}
+
+	return hasCachedTag(cacheDir, tag)
+}
+
+// legacyCachedBase returns the tag older versions of stacker cached is under
+// in cacheDir, if there is anything there. Those tags were just the last
+// component of the image name, so e.g. registry-a/team/base and
+// registry-b/base were both "base", and there's no telling which image
+// is cached under one unless is is pinned to a digest (see
+// migrateLegacyCachedBase). Otherwise they are only removed once is has been
+// pulled again.
+func legacyCachedBase(cacheDir string, is *types.ImageSource) (string, error) {
+	tag, err := is.ParseTag()
+	if err != nil {
+		return "", err
+	}
+
+	legacyTag, err := is.LegacyTag()
+	if err != nil {
+		return "", err
+	}
+
+	if legacyTag == tag {
+		return "", nil
+	}
+
+	cached, err := hasCachedTag(cacheDir, legacyTag)
+	if err != nil || !cached {
+		return "", err
+	}
+
+	return legacyTag, nil
+}
+
+// migrateLegacyCachedBase moves the copy of is cached under its legacy tag in
+// cacheDir to its real tag, if it is known to be is: is must be pinned (or
+// locked) to digest d, and the legacy copy must be d, or have been copied
+// from it. It returns true if the copy was migrated.
+func migrateLegacyCachedBase(cacheDir string, is *types.ImageSource, d digest.Digest) (bool, error) {
+	legacyTag, err := legacyCachedBase(cacheDir, is)
+	if err != nil || legacyTag == "" {
+		return false, err
+	}
+
+	url, err := is.ContainersImageURL()
+	if err != nil {
+		return false, err
+	}
+
+	tag, err := is.ParseTag()
+	if err != nil {
+		return false, err
+	}
+
+	oci, err := umoci.OpenLayout(cacheDir)
+	if err != nil {
+		return false, err
+	}
+	defer oci.Close()
+
+	descriptorPaths, err := oci.ResolveReference(context.Background(), legacyTag)
+	if err != nil {
+		return false, err
+	}
+
+	if len(descriptorPaths) != 1 {
+		return false, errors.Errorf("bad descriptor %s", legacyTag)
+	}
+
+	desc := descriptorPaths[0].Root()
+	if d == "" || (desc.Digest != d && desc.Annotations[SourceDigestAnnotation] != d.String()) {
+		log.Infof("not using %s cached by an older version of stacker as %s, it may be a different image", url, legacyTag)
+		return false, nil
+	}
+
+	log.Infof("migrating %s cached by an older version of stacker as %s", url, legacyTag)
+	annotations := map[string]string{}
+	for k, v := range desc.Annotations {
+		annotations[k] = v
+	}
+	annotations[SourceDigestAnnotation] = d.String()
+	desc.Annotations = annotations
+
+	if err := oci.UpdateReference(context.Background(), tag, desc); err != nil {
+		return false, err
+	}
+
+	return true, oci.DeleteReference(context.Background(), legacyTag)
+}
+
+func hasCachedTag(cacheDir string, tag string) (bool, error) {
+	if _, err := os.Stat(cacheDir); os.IsNotExist(err) {
+		return false, nil
+	}
+
+	oci, err := umoci.OpenLayout(cacheDir)
+	if err != nil {
+		return false, err
+	}
+	defer oci.Close()
+
+	descriptorPaths, err := oci.ResolveReference(context.Background(), tag)
+	if err != nil {
+		return false, err
+	}
+
+	return len(descriptorPaths) > 0, nil
+}
+
+// dropLegacyCachedBase removes anything cached under is's legacy tag in
+// cacheDir, now that is has been pulled under its real one.
+func dropLegacyCachedBase(cacheDir string, is *types.ImageSource) error {
+	legacyTag, err := legacyCachedBase(cacheDir, is)
+	if err != nil || legacyTag == "" {
+		return err
+	}
+
+	oci, err := umoci.OpenLayout(cacheDir)
+	if err != nil {
+		return err
+	}
+	defer oci.Close()
+
+	log.Infof("removing %s from the layer-bases cache, older versions of stacker cached bases under that ambiguous name", legacyTag)
+	return oci.DeleteReference(context.Background(), legacyTag)
+}
+
+// isLocalImage returns true if is never comes from the network:
+// containers-storage images are read straight out of the local storage, so
+// they are fine offline and there is nothing about them to lock.
+func isLocalImage(is *types.ImageSource) bool {
+	return is.Type == types.ContainersStorageLayer
+}
+
+func isHttpUrl(thing string) (bool, error) {
+	url, err := types.NewDockerishUrl(thing)
+	if err != nil {
+		return false, err
+	}
+
+	return url.Scheme == "http" || url.Scheme == "https", nil
+}
+
+// checkOfflineInputs walks all the layers in sfm and makes sure that every
+// input that would normally be fetched over the network (docker/oci bases,
+// apply images, and http imports or tar bases) is already in stacker's
+// caches. The result is a single types.NeedsNetworkError listing everything
+// that's missing (including missingStackerfiles, the remote stackerfiles that
+// aren't cached), so that an offline build fails before any layer is built.
+func checkOfflineInputs(config types.StackerConfig, sfm types.StackerFiles, missingStackerfiles []string) error {
+	missing := map[string]bool{}
+	for _, sf := range missingStackerfiles {
+		missing[sf] = true
+	}
+
+	cacheDir := path.Join(config.StackerDir, "layer-bases", "oci")
+
+	checkImage := func(lc *lockChecker, is *types.ImageSource) error {
+		if isLocalImage(is) {
+			return nil
+		}
+
+		cached, err := hasCachedBase(cacheDir, is)
+		if err != nil {
+			return err
+		}
+
+		// copies cached by older versions of stacker count if we can
+		// tell they're the right image
+		if !cached {
+			locked, err := lc.lockedDigest(is)
+			if err != nil {
+				return err
+			}
+
+			pinned, err := pullDigest(is, locked)
+			if err != nil {
+				return err
+			}
+
+			cached, err = migrateLegacyCachedBase(cacheDir, is, pinned)
+			if err != nil {
+				return err
+			}
+		}
+
+		// a copy verified under some other signature policy doesn't
+		// count either
+		if cached {
+			cached, err = cachedUnderPolicy(is, config, cacheDir)
+			if err != nil {
+				return err
+			}
+		}
+
+		if !cached {
+			url, err := is.ContainersImageURL()
+			if err != nil {
+				return err
+			}
+			missing[url] = true
+		}
+
+		return nil
+	}
+
+	checkFile := func(url string, cacheDir string) error {
+		isHttp, err := isHttpUrl(url)
+		if err != nil {
+			return err
+		}
+
+		if !isHttp {
+			return nil
+		}
+
+		if _, err := os.Stat(path.Join(cacheDir, path.Base(url))); err != nil {
+			missing[url] = true
+		}
+
+		return nil
+	}
+
+	for _, sf := range sfm {
+		lc, err := newLockChecker(sf, false)
+		if err != nil {
+			return err
+		}
+
+		for _, name := range sf.FileOrder {
+			l, ok := sf.Get(name)
+			if !ok {
+				continue
+			}
+
+			switch l.From.Type {
+			case types.DockerLayer, types.OCILayer, types.ContainersStorageLayer:
+				if err := checkImage(lc, l.From); err != nil {
+					return err
+				}
+			case types.TarLayer, types.SquashfsLayer:
+				if err := checkFile(l.From.Url, path.Join(config.StackerDir, "layer-bases")); err != nil {
+					return err
+				}
+			}
+
+			applies, err := l.ParseApply()
+			if err != nil {
+				return err
+			}
+
+			for _, is := range applies {
+				if is.Type == types.BuiltLayer {
+					continue
+				}
+
+				if err := checkImage(lc, is); err != nil {
+					return err
+				}
+			}
+
+			imports, err := l.ParseImport()
+			if err != nil {
+				return err
+			}
+
+			for _, imp := range imports {
+				if err := checkFile(imp, path.Join(config.StackerDir, "imports", name)); err != nil {
+					return err
+				}
+			}
+		}
+	}
+
+	if len(missing) == 0 {
+		return nil
+	}
+
+	nne := &types.NeedsNetworkError{}
+	for m := range missing {
+		nne.Missing = append(nne.Missing, m)
+	}
+	sort.Strings(nne.Missing)
+	return nne
+}
@@ -0,0 +1,215 @@
+package stacker
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"sync"
+
+	"github.com/anuvu/stacker/lib"
+	"github.com/anuvu/stacker/log"
+	"github.com/anuvu/stacker/types"
+	"github.com/opencontainers/go-digest"
+	"github.com/pkg/errors"
+)
+
+type PrefetchArgs struct {
+	Config     types.StackerConfig
+	Substitute []string
+	PullPolicy string
+	Jobs       int
+	Progress   bool
+}
+
+// Prefetch warms the layer-bases cache with every docker/oci base, apply
+// image, and http tar base referenced by the stackerfiles in paths (and their
+// prerequisites), so that a later build doesn't need the network.
+func Prefetch(opts PrefetchArgs, paths []string) error {
+	sfm, err := types.NewStackerFiles(paths, append(opts.Substitute, opts.Config.Substitutions()...), opts.Config)
+	if err != nil {
+		return err
+	}
+
+	layerBases := path.Join(opts.Config.StackerDir, "layer-bases")
+	cacheDir := path.Join(layerBases, "oci")
+	if err := os.MkdirAll(cacheDir, 0755); err != nil {
+		return err
+	}
+
+	// images are keyed by the url they're pulled from (and the platform
+	// they're pulled for), so that the same image used as a base and
+	// applied somewhere else is only pulled once. Like in a build, images
+	// locked in a stackerfile's lockfile are pulled by their locked digest.
+	images := map[string]*types.ImageSource{}
+	lockedDigests := map[string]digest.Digest{}
+	addImage := func(lc *lockChecker, is *types.ImageSource) error {
+		url, err := is.ContainersImageURL()
+		if err != nil {
+			return err
+		}
+
+		if is.Platform != "" {
+			url = fmt.Sprintf("%s (%s)", url, is.Platform)
+		}
+
+		locked, err := lc.lockedDigest(is)
+		if err != nil {
+			return err
+		}
+
+		if prev, ok := images[url]; ok && lockedDigests[url] != locked {
+			return errors.Errorf("%s is locked to both %s and %s", prev.Url, lockedDigests[url], locked)
+		}
+
+		images[url] = is
+		lockedDigests[url] = locked
+		return nil
+	}
+
+	tars := map[string]bool{}
+	for _, sf := range sfm {
+		lc, err := newLockChecker(sf, false)
+		if err != nil {
+			return err
+		}
+
+		for _, name := range sf.FileOrder {
+			l, ok := sf.Get(name)
+			if !ok {
+				return errors.Errorf("%s not present in stackerfile?", name)
+			}
+
+			switch l.From.Type {
+			case types.DockerLayer, types.OCILayer, types.ContainersStorageLayer:
+				if err := addImage(lc, l.From); err != nil {
+					return err
+				}
+			case types.TarLayer, types.SquashfsLayer:
+				tars[l.From.Url] = true
+			}
+
+			applies, err := l.ParseApply()
+			if err != nil {
+				return err
+			}
+
+			for _, is := range applies {
+				if is.Type == types.BuiltLayer {
+					continue
+				}
+
+				if err := addImage(lc, is); err != nil {
+					return err
+				}
+			}
+		}
+	}
+
+	jobs := opts.Jobs
+	if jobs < 1 {
+		jobs = 1
+	}
+
+	// with more than one job, the progress bars would just stomp on each
+	// other.
+	progress := opts.Progress && jobs == 1
+
+	var wg sync.WaitGroup
+	var lock sync.Mutex
+	sem := make(chan struct{}, jobs)
+	errs := []error{}
+
+	fail := func(err error) {
+		lock.Lock()
+		defer lock.Unlock()
+		errs = append(errs, err)
+	}
+
+	for url, is := range images {
+		pull, err := needsPull(is, opts.Config, opts.PullPolicy, cacheDir, lockedDigests[url])
+		if err != nil {
+			return err
+		}
+
+		if !pull {
+			continue
+		}
+
+		wg.Add(1)
+		go func(url string, is *types.ImageSource, locked digest.Digest) {
+			defer wg.Done()
+			sem <- struct{}{}
+			defer func() { <-sem }()
+
+			// containers/image rewrites the OCI index wholesale
+			// when it copies an image, so concurrent copies to the
+			// same layout would clobber each other. Instead, let's
+			// download into a private layout, and only serialize
+			// the (local) copy into the cache.
+			staging, err := ioutil.TempDir(layerBases, "prefetch-")
+			if err != nil {
+				fail(err)
+				return
+			}
+			defer os.RemoveAll(staging)
+
+			if err := pullContainersImage(is, opts.Config, staging, progress, locked); err != nil {
+				fail(err)
+				return
+			}
+
+			tag, err := is.ParseTag()
+			if err != nil {
+				fail(err)
+				return
+			}
+
+			lock.Lock()
+			defer lock.Unlock()
+			err = lib.ImageCopy(lib.ImageCopyOpts{
+				Src:  fmt.Sprintf("oci:%s:%s", staging, tag),
+				Dest: fmt.Sprintf("oci:%s:%s", cacheDir, tag),
+			})
+			if err != nil {
+				errs = append(errs, errors.Wrapf(err, "couldn't cache %s", url))
+				return
+			}
+
+			// the copy doesn't carry index annotations over, so
+			// let's re-record where the cached image came from.
+			annotations, err := cachedBaseAnnotations(staging, tag)
+			if err == nil {
+				err = setCachedBaseAnnotations(cacheDir, tag, annotations)
+			}
+			if err != nil {
+				errs = append(errs, errors.Wrapf(err, "couldn't cache %s", url))
+			}
+		}(url, is, lockedDigests[url])
+	}
+
+	for url := range tars {
+		wg.Add(1)
+		go func(url string) {
+			defer wg.Done()
+			sem <- struct{}{}
+			defer func() { <-sem }()
+
+			if _, err := acquireUrl(opts.Config, url, layerBases, progress); err != nil {
+				fail(err)
+			}
+		}(url)
+	}
+
+	wg.Wait()
+
+	for _, err := range errs {
+		log.Infof("prefetch failed: %v", err)
+	}
+
+	if len(errs) > 0 {
+		return errors.Errorf("failed to prefetch %d input(s)", len(errs))
+	}
+
+	return nil
+}
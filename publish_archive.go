@@ -0,0 +1,182 @@
+package stacker
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"sync"
+
+	"github.com/anuvu/stacker/lib"
+	"github.com/anuvu/stacker/log"
+	"github.com/opencontainers/go-digest"
+	"github.com/opencontainers/umoci"
+	"github.com/pkg/errors"
+)
+
+// These are the publish destinations that are written as a single tarball
+// containing every published image.
+const (
+	ociArchive    = "oci-archive"
+	dockerArchive = "docker-archive"
+)
+
+// publishArchive is an oci-archive: or docker-archive: publish destination.
+// The archive is written next to its path, and only replaces it once
+// everything in it has been published.
+//
+// containers/image's oci-archive transport writes a whole new archive for
+// each image copied to it, so images are copied into an OCI layout under the
+// stacker dir instead, which is archived (the same way the transport would)
+// once they all have been. Its docker-archive transport writes one image,
+// with any number of tags, so that one image is copied straight to it.
+type publishArchive struct {
+	kind    string
+	path    string
+	tmp     string // the archive being written
+	staging string // the OCI layout an oci-archive is staged in
+
+	// a docker-archive's one image: its tags, and the outcome of writing
+	// it
+	tags   []string
+	once   sync.Once
+	digest digest.Digest
+	err    error
+}
+
+// parsePublishArchive returns the archive url refers to, or nil if url isn't
+// an archive.
+func parsePublishArchive(url string) (*publishArchive, error) {
+	for _, kind := range []string{ociArchive, dockerArchive} {
+		if !strings.HasPrefix(url, kind+":") {
+			continue
+		}
+
+		p := url[len(kind)+1:]
+		if p == "" || strings.Contains(p, ":") {
+			return nil, errors.Errorf("%s should be %s:path/to/archive.tar", url, kind)
+		}
+
+		return &publishArchive{kind: kind, path: p}, nil
+	}
+
+	return nil, nil
+}
+
+// destUrl returns the url the image called name with tag is published to in
+// the archive.
+func (a *publishArchive) destUrl(name string, tag string) string {
+	if a.kind == ociArchive {
+		return fmt.Sprintf("%s:%s:%s_%s", a.kind, a.path, name, tag)
+	}
+
+	return fmt.Sprintf("%s:%s:%s:%s", a.kind, a.path, name, tag)
+}
+
+// plan makes sure jobs fit in the archive: a docker-archive only holds one
+// image, so they all have to publish the same one (as different tags).
+func (a *publishArchive) plan(jobs []*publishJob) error {
+	if a.kind != dockerArchive {
+		return nil
+	}
+
+	for _, job := range jobs {
+		if job.src != jobs[0].src {
+			return errors.Errorf("%s and %s can't both be published to one docker-archive, publish them to an oci-archive instead", jobs[0].what, job.what)
+		}
+
+		a.tags = append(a.tags, fmt.Sprintf("%s:%s", job.name, job.tag))
+	}
+
+	return nil
+}
+
+// copy copies the image copyOpts.Src, published as destUrl, into the archive
+// and returns the digest of the manifest written.
+func (a *publishArchive) copy(stackerDir string, copyOpts lib.ImageCopyOpts, destUrl string) (digest.Digest, error) {
+	if err := a.create(stackerDir); err != nil {
+		return "", err
+	}
+
+	if a.kind == ociArchive {
+		ref := strings.TrimPrefix(destUrl, fmt.Sprintf("%s:%s:", a.kind, a.path))
+		copyOpts.Dest = fmt.Sprintf("oci:%s:%s", path.Join(a.staging, "oci"), ref)
+		return lib.ImageCopyDigest(copyOpts)
+	}
+
+	// the image is written with all of its tags when the first of them
+	// is published; the rest are already there.
+	a.once.Do(func() {
+		copyOpts.Dest = fmt.Sprintf("%s:%s:%s", a.kind, a.tmp, a.tags[0])
+		copyOpts.DestAdditionalTags = a.tags[1:]
+		a.digest, a.err = lib.ImageCopyDigest(copyOpts)
+	})
+
+	return a.digest, a.err
+}
+
+// create creates the file the archive is written to, and for oci-archives,
+// the layout it is staged in.
+func (a *publishArchive) create(stackerDir string) error {
+	if a.tmp != "" {
+		return nil
+	}
+
+	f, err := ioutil.TempFile(path.Dir(a.path), path.Base(a.path)+".tmp-")
+	if err != nil {
+		return errors.Wrapf(err, "couldn't create %s", a.path)
+	}
+	f.Close()
+	a.tmp = f.Name()
+
+	if a.kind != ociArchive {
+		return nil
+	}
+
+	if err := os.MkdirAll(stackerDir, 0755); err != nil {
+		return err
+	}
+
+	a.staging, err = ioutil.TempDir(stackerDir, "publish-archive-")
+	if err != nil {
+		return errors.Wrapf(err, "couldn't create staging dir for %s", a.path)
+	}
+
+	oci, err := umoci.CreateLayout(path.Join(a.staging, "oci"))
+	if err != nil {
+		return err
+	}
+
+	return oci.Close()
+}
+
+// write replaces the archive with everything that has been published to it.
+func (a *publishArchive) write() error {
+	if a.tmp == "" {
+		return nil
+	}
+
+	log.Infof("writing %s %s", a.kind, a.path)
+	if a.kind == ociArchive {
+		if err := lib.TarDir(path.Join(a.staging, "oci"), a.tmp); err != nil {
+			return err
+		}
+	}
+
+	return errors.Wrapf(os.Rename(a.tmp, a.path), "couldn't write %s", a.path)
+}
+
+// cleanup removes the staged images, and the new archive if it wasn't
+// written.
+func (a *publishArchive) cleanup() error {
+	if a.tmp == "" {
+		return nil
+	}
+
+	if err := os.RemoveAll(a.tmp); err != nil {
+		return err
+	}
+
+	return os.RemoveAll(a.staging)
+}
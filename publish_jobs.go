@@ -0,0 +1,206 @@
+package stacker
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/anuvu/stacker/log"
+	"github.com/anuvu/stacker/types"
+	"github.com/opencontainers/go-digest"
+	"github.com/pkg/errors"
+)
+
+// retryDelay is how long to wait before retrying a failed push the first
+// time; it doubles for each retry after that.
+var retryDelay = time.Second
+
+// publishJob is one image (or image index) to publish to one destination.
+type publishJob struct {
+	src       string
+	is        *types.ImageSource
+	name      string
+	tag       string
+	layers    []string
+	what      string
+	allImages bool
+	destUrl   string
+
+	// the outcome, once it has run
+	digest    digest.Digest
+	unchanged bool
+	err       error
+}
+
+// selectLayer returns true if the layer called name should be published,
+// i.e. it matches one of the --layer globs, or there aren't any.
+func (p *Publisher) selectLayer(name string) bool {
+	if len(p.opts.Layers) == 0 {
+		return true
+	}
+
+	selected := false
+	for _, pattern := range p.opts.Layers {
+		// patterns are validated in PublishMultiple
+		if ok, _ := filepath.Match(pattern, name); ok {
+			p.selected[pattern] = true
+			selected = true
+		}
+	}
+
+	return selected
+}
+
+// addJob arranges for src, built from layers, to be published as name:tag.
+// what describes src for the logs; allImages publishes every image in src if
+// it's an index.
+func (p *Publisher) addJob(src string, is *types.ImageSource, name string, tag string, layers []string, what string, allImages bool) error {
+	destUrl, err := p.destUrl(is, name, tag)
+	if err != nil {
+		return err
+	}
+
+	p.jobs = append(p.jobs, &publishJob{
+		src:       src,
+		is:        is,
+		name:      name,
+		tag:       tag,
+		layers:    layers,
+		what:      what,
+		allImages: allImages,
+		destUrl:   destUrl,
+	})
+	return nil
+}
+
+// runJobs publishes everything, --jobs images at a time. Failures are
+// recorded in the jobs rather than stopping everything else from being
+// published.
+func (p *Publisher) runJobs() {
+	jobs := p.opts.Jobs
+	if jobs < 1 {
+		jobs = 1
+	}
+
+	// containers/image can't write to the same OCI layout (or archive)
+	// from several copies at once.
+	if jobs > 1 && (p.archive != nil || !strings.HasPrefix(p.opts.Url, "docker://")) {
+		log.Infof("publishing one image at a time, only registries can be published to concurrently")
+		jobs = 1
+	}
+
+	queue := make(chan *publishJob)
+	wg := sync.WaitGroup{}
+	for i := 0; i < jobs; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for job := range queue {
+				p.run(job)
+			}
+		}()
+	}
+
+	for _, job := range p.jobs {
+		queue <- job
+	}
+	close(queue)
+	wg.Wait()
+}
+
+// run publishes job, or just says it would if --show-only was passed. Nothing
+// is copied if the destination already has the same manifest. If --sign-key
+// was passed, the published manifest is signed too.
+func (p *Publisher) run(job *publishJob) {
+	if p.opts.ShowOnly {
+		// User has requested only to see what would be published
+		log.Infof("would publish: %s to %s", job.what, job.destUrl)
+		return
+	}
+
+	job.digest, job.unchanged, job.err = p.unchanged(job.src, job.destUrl)
+	if job.err != nil {
+		return
+	}
+
+	if job.unchanged {
+		log.Infof("%s is already published to %s, not publishing it again", job.what, job.destUrl)
+	} else {
+		// Store the layers to new destination
+		log.Infof("publishing %s to %s\n", job.what, job.destUrl)
+		job.digest, job.err = p.imageCopy(job.src, job.destUrl, job.allImages)
+		if job.err != nil {
+			return
+		}
+	}
+
+	if p.signer != nil {
+		job.err = p.sign(job.is, job.name, job.digest, job.unchanged)
+	}
+}
+
+// summary logs what was published, and returns an error if anything failed.
+func (p *Publisher) summary() error {
+	succeeded := []string{}
+	skipped := []string{}
+	failed := []string{}
+	for _, job := range p.jobs {
+		line := fmt.Sprintf("%s to %s", job.what, job.destUrl)
+		switch {
+		case job.err != nil:
+			failed = append(failed, fmt.Sprintf("%s: %v", line, job.err))
+		case job.unchanged:
+			skipped = append(skipped, line)
+		default:
+			succeeded = append(succeeded, line)
+		}
+	}
+
+	log.Infof("publish summary: %d succeeded, %d skipped (unchanged), %d failed", len(succeeded), len(skipped), len(failed))
+	for _, line := range succeeded {
+		log.Infof("  succeeded: %s", line)
+	}
+	for _, line := range skipped {
+		log.Infof("  skipped: %s", line)
+	}
+	for _, line := range failed {
+		log.Infof("  failed: %s", line)
+	}
+
+	if len(failed) > 0 {
+		return errors.Errorf("%d of %d pushes failed", len(failed), len(p.jobs))
+	}
+
+	return nil
+}
+
+// writeDigestFile writes everything that was published to --digest-file.
+func (p *Publisher) writeDigestFile() error {
+	digests := []PublishedDigest{}
+	for _, job := range p.jobs {
+		if job.err != nil {
+			continue
+		}
+
+		digests = append(digests, PublishedDigest{
+			Name:        job.name,
+			Layers:      job.layers,
+			Tag:         job.tag,
+			Destination: job.destUrl,
+			Digest:      job.digest,
+			Unchanged:   job.unchanged,
+		})
+	}
+
+	content, err := json.MarshalIndent(digests, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	err = ioutil.WriteFile(p.opts.DigestFile, append(content, '\n'), 0644)
+	return errors.Wrapf(err, "couldn't write digest file %s", p.opts.DigestFile)
+}
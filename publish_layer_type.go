@@ -0,0 +1,229 @@
+package stacker
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/anuvu/stacker/lib"
+	"github.com/anuvu/stacker/log"
+	stackeroci "github.com/anuvu/stacker/oci"
+	"github.com/anuvu/stacker/types"
+	"github.com/opencontainers/go-digest"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/opencontainers/umoci"
+	"github.com/opencontainers/umoci/oci/casext"
+	"github.com/pkg/errors"
+)
+
+// sourceDir returns the OCI layout images are published from: the output
+// layout, or with --layer-type, the cache of converted images (which
+// --show-only doesn't bother filling in).
+func (p *Publisher) sourceDir() string {
+	if p.opts.LayerType == "" || p.opts.ShowOnly {
+		return p.opts.Config.OCIDir
+	}
+
+	return path.Join(p.opts.Config.StackerDir, "publish-layer-types", "oci")
+}
+
+// hasLayerType returns true if every layer in manifest is of layerType.
+func hasLayerType(manifest ispec.Manifest, layerType string) bool {
+	for _, desc := range manifest.Layers {
+		switch desc.MediaType {
+		case stackeroci.MediaTypeLayerSquashfs:
+			if layerType != "squashfs" {
+				return false
+			}
+		case ispec.MediaTypeImageLayer, ispec.MediaTypeImageLayerGzip:
+			if layerType != "tar" {
+				return false
+			}
+		default:
+			return false
+		}
+	}
+
+	return true
+}
+
+// convertLayerType returns the tag in sourceDir() of the image called name in
+// oci, with its layers rendered as --layer-type. Converted images are cached
+// by the digest of the image they came from, so publishing an image that
+// hasn't been rebuilt doesn't convert it again (and publishes the same digest
+// as last time).
+func (p *Publisher) convertLayerType(s types.Storage, oci casext.Engine, name string) (string, error) {
+	if p.opts.LayerType == "" {
+		return name, nil
+	}
+
+	ctx := context.Background()
+	descPaths, err := oci.ResolveReference(ctx, name)
+	if err != nil {
+		return "", err
+	}
+
+	if len(descPaths) != 1 {
+		return "", errors.Errorf("couldn't find %s in %s", name, p.opts.Config.OCIDir)
+	}
+
+	source := descPaths[0].Descriptor()
+	tag := fmt.Sprintf("%s_%s", p.opts.LayerType, source.Digest.Encoded())
+
+	cacheDir := p.sourceDir()
+	var cache casext.Engine
+	if _, statErr := os.Stat(cacheDir); statErr != nil {
+		cache, err = umoci.CreateLayout(cacheDir)
+	} else {
+		cache, err = umoci.OpenLayout(cacheDir)
+	}
+	if err != nil {
+		return "", err
+	}
+	defer cache.Close()
+
+	cached, err := cache.ResolveReference(ctx, tag)
+	if err != nil {
+		return "", err
+	}
+
+	if len(cached) == 1 {
+		log.Debugf("using cached %s layers of %s", p.opts.LayerType, name)
+		return tag, nil
+	}
+
+	manifest, err := stackeroci.LookupManifest(oci, name)
+	if err != nil {
+		return "", err
+	}
+
+	// if the layer types are the same, just copy it over and be done
+	if hasLayerType(manifest, p.opts.LayerType) {
+		err = lib.ImageCopy(lib.ImageCopyOpts{
+			Src:  fmt.Sprintf("oci:%s:%s", p.opts.Config.OCIDir, name),
+			Dest: fmt.Sprintf("oci:%s:%s", cacheDir, tag),
+		})
+		if err != nil {
+			return "", err
+		}
+
+		return tag, p.replaceConverted(cache, name, tag)
+	}
+
+	log.Infof("converting %s to %s layers", name, p.opts.LayerType)
+
+	config, err := stackeroci.LookupConfig(oci, manifest.Config)
+	if err != nil {
+		return "", err
+	}
+
+	// render the whole filesystem as one layer
+	bundle := "stacker-publish-" + tag
+	if s.Exists(bundle) {
+		if err := s.Delete(bundle); err != nil {
+			return "", err
+		}
+	}
+
+	if err := s.Create(bundle); err != nil {
+		return "", err
+	}
+	defer s.Delete(bundle)
+
+	if err := s.Unpack(p.opts.Config.OCIDir, name, bundle); err != nil {
+		return "", err
+	}
+
+	rootfsPath := path.Join(p.opts.Config.RootFSDir, bundle, "rootfs")
+	desc, diffID, err := renderLayer(cache, cacheDir, rootfsPath, p.opts.LayerType, true)
+	if err != nil {
+		return "", errors.Wrapf(err, "couldn't convert %s to %s", name, p.opts.LayerType)
+	}
+
+	manifest.Layers = []ispec.Descriptor{desc}
+	config.RootFS.DiffIDs = []digest.Digest{diffID}
+
+	// the history stays, but none of it refers to a layer any more; the
+	// one layer there is comes from the conversion.
+	for i := range config.History {
+		config.History[i].EmptyLayer = true
+	}
+	now := time.Now()
+	config.History = append(config.History, ispec.History{
+		Created:   &now,
+		CreatedBy: fmt.Sprintf("stacker publish --layer-type %s repack of %s", p.opts.LayerType, name),
+	})
+
+	configDigest, configSize, err := cache.PutBlobJSON(ctx, config)
+	if err != nil {
+		return "", err
+	}
+
+	manifest.Config = ispec.Descriptor{
+		MediaType: ispec.MediaTypeImageConfig,
+		Digest:    configDigest,
+		Size:      configSize,
+	}
+
+	manifestDigest, manifestSize, err := cache.PutBlobJSON(ctx, manifest)
+	if err != nil {
+		return "", err
+	}
+
+	err = cache.UpdateReference(ctx, tag, ispec.Descriptor{
+		MediaType: ispec.MediaTypeImageManifest,
+		Digest:    manifestDigest,
+		Size:      manifestSize,
+	})
+	if err != nil {
+		return "", err
+	}
+
+	return tag, p.replaceConverted(cache, name, tag)
+}
+
+// replaceConverted records that tag in cache is the layer called name
+// converted to --layer-type, and removes what name was converted to before it
+// was last rebuilt, since nothing will publish that again.
+func (p *Publisher) replaceConverted(cache casext.Engine, name string, tag string) error {
+	ctx := context.Background()
+	descPaths, err := cache.ResolveReference(ctx, tag)
+	if err != nil {
+		return err
+	}
+
+	if len(descPaths) != 1 {
+		return errors.Errorf("bad descriptor %s", tag)
+	}
+
+	desc := descPaths[0].Root()
+	if desc.Annotations == nil {
+		desc.Annotations = map[string]string{}
+	}
+	desc.Annotations[ConvertedLayerAnnotation] = name
+	if err := cache.UpdateReference(ctx, tag, desc); err != nil {
+		return err
+	}
+
+	index, err := cache.GetIndex(ctx)
+	if err != nil {
+		return err
+	}
+
+	for _, m := range index.Manifests {
+		ref := m.Annotations[ispec.AnnotationRefName]
+		if ref == tag || m.Annotations[ConvertedLayerAnnotation] != name || !strings.HasPrefix(ref, p.opts.LayerType+"_") {
+			continue
+		}
+
+		log.Debugf("removing %s, the stale %s layers of %s", ref, p.opts.LayerType, name)
+		if err := cache.DeleteReference(ctx, ref); err != nil {
+			return err
+		}
+	}
+
+	return cache.GC(ctx)
+}
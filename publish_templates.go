@@ -0,0 +1,111 @@
+package stacker
+
+import (
+	"strings"
+
+	stackeroci "github.com/anuvu/stacker/oci"
+	"github.com/anuvu/stacker/types"
+	"github.com/opencontainers/umoci/oci/casext"
+	"github.com/pkg/errors"
+)
+
+// publishNames returns the name the layer called name in sf is published as,
+// and the tags it is published with, rendering the layer's publish: templates
+// or --name-template and --tag-template.
+func (p *Publisher) publishNames(sf *types.Stackerfile, oci casext.Engine, name string, l *types.Layer) (string, []string, error) {
+	nameTemplate := p.opts.NameTemplate
+	tagTemplate := p.opts.TagTemplate
+	if l.Publish != nil {
+		if l.Publish.Name != "" {
+			nameTemplate = l.Publish.Name
+		}
+		if l.Publish.Tag != "" {
+			tagTemplate = l.Publish.Tag
+		}
+	}
+
+	data := types.PublishTemplateData{Layer: name}
+
+	// only look at the image if the templates can refer to it
+	if strings.Contains(nameTemplate+tagTemplate, "{{") {
+		var err error
+		data, err = p.templateData(sf, oci, name, nameTemplate+tagTemplate)
+		if err != nil {
+			return "", nil, err
+		}
+	}
+
+	publishName := name
+	if nameTemplate != "" {
+		var err error
+		publishName, err = types.RenderPublishTemplate(nameTemplate, data)
+		if err != nil {
+			return "", nil, errors.Wrapf(err, "couldn't render publish name for %s", name)
+		}
+	}
+
+	tags := []string{}
+outer:
+	for _, tag := range p.opts.Tags {
+		if tagTemplate != "" {
+			var err error
+			tag, err = types.RenderPublishTemplate(tagTemplate, types.PublishTagTemplateData{PublishTemplateData: data, Tag: tag})
+			if err != nil {
+				return "", nil, errors.Wrapf(err, "couldn't render publish tag for %s", name)
+			}
+		}
+
+		// templates that don't use .Tag render the same tag every time
+		for _, existing := range tags {
+			if existing == tag {
+				continue outer
+			}
+		}
+
+		tags = append(tags, tag)
+	}
+
+	return publishName, tags, nil
+}
+
+// templateData returns what the publish templates for the layer called name
+// in sf can refer to.
+func (p *Publisher) templateData(sf *types.Stackerfile, oci casext.Engine, name string, templates string) (types.PublishTemplateData, error) {
+	data := types.PublishTemplateData{
+		Layer:         name,
+		Labels:        map[string]string{},
+		Substitutions: map[string]string{},
+	}
+
+	for _, subst := range append(p.opts.Substitute, p.opts.Config.Substitutions()...) {
+		parts := strings.SplitN(subst, "=", 2)
+		if len(parts) == 2 {
+			data.Substitutions[parts[0]] = parts[1]
+		}
+	}
+
+	manifest, err := stackeroci.LookupManifest(oci, name)
+	if err != nil {
+		return data, err
+	}
+
+	config, err := stackeroci.LookupConfig(oci, manifest.Config)
+	if err != nil {
+		return data, err
+	}
+
+	for k, v := range config.Config.Labels {
+		data.Labels[k] = v
+	}
+
+	// the version the image was built from, if stacker recorded it
+	data.GitVersion = manifest.Annotations[GitVersionAnnotation]
+	if data.GitVersion == "" {
+		data.GitVersion, err = GitVersion(sf.ReferenceDirectory)
+		if err != nil && strings.Contains(templates, ".GitVersion") {
+			return data, errors.Wrapf(err, "couldn't get git version of %s for %s", sf.ReferenceDirectory, name)
+		}
+	}
+
+	return data, nil
+}
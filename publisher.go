@@ -1,16 +1,25 @@
 package stacker
 
 import (
+	"context"
+	"crypto"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"os"
 	"path/filepath"
 	"regexp"
+	"sort"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/anuvu/stacker/lib"
 	"github.com/anuvu/stacker/log"
 	"github.com/anuvu/stacker/types"
+	"github.com/opencontainers/go-digest"
+	"github.com/opencontainers/image-spec/specs-go"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
 	"github.com/opencontainers/umoci"
 	"github.com/opencontainers/umoci/oci/casext"
 	"github.com/pkg/errors"
@@ -26,12 +35,70 @@ type PublishArgs struct {
 	Password   string
 	Force      bool
 	Progress   bool
+	TLSVerify  bool
+	CertDir    string
+	MultiArch  bool
+	SignKey    string
+	DigestFile string
+
+	// NameTemplate and TagTemplate are templates for the names and tags
+	// layers are published with, see types.PublishTemplateData.
+	NameTemplate string
+	TagTemplate  string
+
+	// Layers are globs of the layer names to publish; if it is empty,
+	// every layer is published.
+	Layers []string
+	// Jobs is how many images to publish concurrently, and Retries is how
+	// many times to retry publishing each image if it fails.
+	Jobs    int
+	Retries int
+
+	// LayerType converts the published images to tar or squashfs layers;
+	// if it is empty, images are published with the layers they were
+	// built with.
+	LayerType string
+}
+
+// PublishedDigest records the digest of an image published to a destination,
+// for --digest-file.
+type PublishedDigest struct {
+	Name        string        `json:"name"`
+	Layers      []string      `json:"layers"`
+	Tag         string        `json:"tag"`
+	Destination string        `json:"destination"`
+	Digest      digest.Digest `json:"digest"`
+	Unchanged   bool          `json:"unchanged"`
 }
 
 // Publisher is responsible for publishing the layers based on stackerfiles
 type Publisher struct {
-	stackerfiles types.StackerFiles // Keep track of all the Stackerfiles to publish
-	opts         *PublishArgs       // Publish options
+	stackerfiles types.StackerFiles          // Keep track of all the Stackerfiles to publish
+	opts         *PublishArgs                // Publish options
+	published    map[string][]publishedLayer // The layers published under each publish name
+	archive      *publishArchive             // The archive being published to, if any
+	signer       crypto.Signer               // The key to sign published images with, if any
+	signed       map[string]*signing         // The signatures that have been published
+	jobs         []*publishJob               // The images to publish
+	indexTags    []string                    // Temporary tags for --multi-arch indexes
+	selected     map[string]bool             // The --layer globs that matched something
+	mu           sync.Mutex                  // Protects signed while publishing
+}
+
+// signing is the publishing of one signature, which several jobs (e.g. the
+// same image under different tags) may be waiting for.
+type signing struct {
+	once sync.Once
+	err  error
+}
+
+// publishedLayer is a layer that is published, and where it came from.
+type publishedLayer struct {
+	file  string
+	name  string
+	layer *types.Layer
+	tags  []string
+	src   string // the image's tag in sourceDir()
 }
 
 // NewPublisher initializes a new Publisher struct
@@ -39,11 +106,20 @@ func NewPublisher(opts *PublishArgs) *Publisher {
 	return &Publisher{
 		stackerfiles: make(map[string]*types.Stackerfile, 1),
 		opts:         opts,
+		published:    map[string][]publishedLayer{},
+		signed:       map[string]*signing{},
+		selected:     map[string]bool{},
 	}
 }
 
-// Publish layers in a single stackerfile
+// Publish publishes the layers in a single stackerfile.
 func (p *Publisher) Publish(file string) error {
+	return p.PublishMultiple([]string{file})
+}
+
+// queue figures out how to publish the layers in a single stackerfile;
+// PublishMultiple does the publishing.
+func (p *Publisher) queue(file string) error {
 	opts := p.opts
 
 	// Use absolute path to identify the file in stackerfile map
@@ -75,16 +151,11 @@ func (p *Publisher) Publish(file string) error {
 		return err
 	}
 
-	// Determine list of tags to be used
-	tags := make([]string, len(opts.Tags))
-	copy(tags, opts.Tags)
-
-	if len(tags) == 0 {
+	if len(opts.Tags) == 0 {
 		return errors.Errorf("can't save OCI images in %s since list of tags is empty\n", file)
 	}
 
-	// Need to determine if URL is docker/oci or something else
-	is, err := types.NewImageSource(opts.Url)
+	is, err := p.destination()
 	if err != nil {
 		return err
 	}
@@ -102,6 +173,11 @@ func (p *Publisher) Publish(file string) error {
 			continue
 		}
 
+		if !p.selectLayer(name) {
+			log.Debugf("will not publish: %s %s doesn't match --layer", file, name)
+			continue
+		}
+
 		// Verify layer is in build cache
 		_, ok, err = buildCache.Lookup(name)
 		if err != nil {
@@ -111,49 +187,415 @@ func (p *Publisher) Publish(file string) error {
 			return errors.Errorf("layer needs to be rebuilt before publishing: %s", name)
 		}
 
+		publishName, tags, err := p.publishNames(sf, oci, name, l)
+		if err != nil {
+			return err
+		}
+
+		if others, ok := p.published[publishName]; ok && !opts.MultiArch {
+			return errors.Errorf("%s and %s are both published as %s, use --multi-arch to publish them as one image index", others[0].name, name, publishName)
+		}
+
+		src := name
+		if !opts.ShowOnly {
+			src, err = p.convertLayerType(s, oci, name)
+			if err != nil {
+				return err
+			}
+		}
+		p.published[publishName] = append(p.published[publishName], publishedLayer{file: file, name: name, layer: l, tags: tags, src: src})
+
+		// with --multi-arch, everything is published as part of an
+		// index once all the stackerfiles have been read.
+		if opts.MultiArch {
+			continue
+		}
+
 		// Iterate through all tags
 		for _, tag := range tags {
-			// Determine full destination URL
-			var destUrl string
-			switch is.Type {
-			case types.DockerLayer:
-				destUrl = fmt.Sprintf("%s/%s:%s", strings.TrimRight(opts.Url, "/"), name, tag)
-			case types.OCILayer:
-				destUrl = fmt.Sprintf("%s:%s_%s", opts.Url, name, tag)
-			default:
-				return errors.Errorf("can't save layers to destination type: %s", is.Type)
+			src := fmt.Sprintf("oci:%s:%s", p.sourceDir(), src)
+			err = p.addJob(src, is, publishName, tag, []string{name}, fmt.Sprintf("%s %s", file, name), false)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// publishIndexes arranges for the layers sharing each publish name to be
+// published as a single OCI image index, with one entry per platform.
+func (p *Publisher) publishIndexes() error {
+	opts := p.opts
+
+	if p.archive != nil && p.archive.kind == dockerArchive {
+		return errors.Errorf("docker-archive can't contain image indexes, publish --multi-arch to an oci-archive instead")
+	}
+
+	is, err := p.destination()
+	if err != nil {
+		return err
+	}
+
+	oci, err := umoci.OpenLayout(p.sourceDir())
+	if err != nil {
+		return err
+	}
+	defer oci.Close()
+
+	names := []string{}
+	for name := range p.published {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, publishName := range names {
+		index := ispec.Index{Versioned: specs.Versioned{SchemaVersion: 2}}
+		platforms := map[string]string{}
+		members := []string{}
+		layers := []string{}
+		tags := p.published[publishName][0].tags
+
+		for _, pl := range p.published[publishName] {
+			if strings.Join(pl.tags, ",") != strings.Join(tags, ",") {
+				return errors.Errorf("%s and %s are both published as %s, but with different tags", layers[0], pl.name, publishName)
 			}
 
-			if opts.ShowOnly {
-				// User has requested only to see what would be published
-				log.Infof("would publish: %s %s to %s", file, name, destUrl)
-				continue
+			platform, err := pl.layer.ParsePlatform()
+			if err != nil {
+				return err
 			}
 
-			var progressWriter io.Writer
-			if p.opts.Progress {
-				progressWriter = os.Stderr
+			ps := types.PlatformString(platform)
+			if other, ok := platforms[ps]; ok {
+				return errors.Errorf("%s and %s are both published as %s for %s", other, pl.name, publishName, ps)
 			}
+			platforms[ps] = pl.name
+			members = append(members, fmt.Sprintf("%s (%s)", pl.name, ps))
+			layers = append(layers, pl.name)
 
-			// Store the layers to new destination
-			log.Infof("publishing %s %s to %s\n", file, name, destUrl)
-			err = lib.ImageCopy(lib.ImageCopyOpts{
-				Src:          fmt.Sprintf("oci:%s:%s", opts.Config.OCIDir, name),
-				Dest:         destUrl,
-				DestUsername: opts.Username,
-				DestPassword: opts.Password,
-				Progress:     progressWriter,
-				SkipTLS:      true,
-			})
+			descPaths, err := oci.ResolveReference(context.Background(), pl.src)
 			if err != nil {
 				return err
 			}
+
+			if len(descPaths) != 1 {
+				return errors.Errorf("couldn't find %s in %s", pl.name, p.sourceDir())
+			}
+
+			desc := descPaths[0].Descriptor()
+			desc.Annotations = nil
+			desc.Platform = &platform
+			index.Manifests = append(index.Manifests, desc)
+		}
+
+		what := fmt.Sprintf("%s [%s]", publishName, strings.Join(members, ", "))
+		if opts.ShowOnly {
+			for _, tag := range tags {
+				if err := p.addJob("", is, publishName, tag, layers, what, true); err != nil {
+					return err
+				}
+			}
+			continue
+		}
+
+		digest, size, err := oci.PutBlobJSON(context.Background(), index)
+		if err != nil {
+			return err
+		}
+
+		// containers/image needs a reference to copy from, so tag the
+		// index in the source layout for the duration of the copy.
+		indexTag := "stacker-publish-index-" + strings.Replace(publishName, "/", "_", -1)
+		err = oci.UpdateReference(context.Background(), indexTag, ispec.Descriptor{
+			MediaType: ispec.MediaTypeImageIndex,
+			Digest:    digest,
+			Size:      size,
+		})
+		if err != nil {
+			return err
+		}
+		p.indexTags = append(p.indexTags, indexTag)
+
+		for _, tag := range tags {
+			src := fmt.Sprintf("oci:%s:%s", p.sourceDir(), indexTag)
+			if err := p.addJob(src, is, publishName, tag, layers, what, true); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// deleteIndexTags removes the temporary tags publishIndexes created.
+func (p *Publisher) deleteIndexTags() error {
+	if len(p.indexTags) == 0 {
+		return nil
+	}
+
+	oci, err := umoci.OpenLayout(p.sourceDir())
+	if err != nil {
+		return err
+	}
+	defer oci.Close()
+
+	for _, indexTag := range p.indexTags {
+		if err := oci.DeleteReference(context.Background(), indexTag); err != nil {
+			return err
 		}
 	}
 
 	return nil
 }
 
+// destination returns the image source for the publish url, or nil if it
+// is an archive.
+func (p *Publisher) destination() (*types.ImageSource, error) {
+	if p.archive != nil {
+		return nil, nil
+	}
+
+	// Need to determine if URL is docker/oci or something else
+	return types.NewImageSource(p.opts.Url)
+}
+
+// destUrl returns the url to publish the image called name with tag to.
+func (p *Publisher) destUrl(is *types.ImageSource, name string, tag string) (string, error) {
+	if p.archive != nil {
+		return p.archive.destUrl(name, tag), nil
+	}
+
+	switch is.Type {
+	case types.DockerLayer:
+		return fmt.Sprintf("%s/%s:%s", strings.TrimRight(p.opts.Url, "/"), name, tag), nil
+	case types.OCILayer:
+		return fmt.Sprintf("%s:%s_%s", p.opts.Url, name, tag), nil
+	default:
+		return "", errors.Errorf("can't save layers to destination type: %s", is.Type)
+	}
+}
+
+// sigUrl returns the url to publish the signature of the manifest with digest
+// d, published as name, to.
+func (p *Publisher) sigUrl(is *types.ImageSource, name string, d digest.Digest) (string, error) {
+	if p.archive != nil {
+		return fmt.Sprintf("%s:%s:%s", p.archive.kind, p.archive.path, lib.SignatureTag(d)), nil
+	}
+
+	// signatures go in the same repository as the image in registries,
+	// but they are only named by digest in OCI layouts.
+	if is.Type == types.OCILayer {
+		return fmt.Sprintf("%s:%s", p.opts.Url, lib.SignatureTag(d)), nil
+	}
+
+	return p.destUrl(is, name, lib.SignatureTag(d))
+}
+
+// sign publishes a signature of the manifest with digest d, which was
+// published as name. If the manifest was already published (unchanged) and
+// has a signature there, it isn't signed again.
+func (p *Publisher) sign(is *types.ImageSource, name string, d digest.Digest, unchanged bool) error {
+	sigUrl, err := p.sigUrl(is, name, d)
+	if err != nil {
+		return err
+	}
+
+	// the same image under several tags only needs one signature, so
+	// whoever gets here first publishes it, and everyone else waits for
+	// (and reports) the result.
+	p.mu.Lock()
+	s, ok := p.signed[sigUrl]
+	if !ok {
+		s = &signing{}
+		p.signed[sigUrl] = s
+	}
+	p.mu.Unlock()
+
+	s.once.Do(func() {
+		if unchanged {
+			current, err := p.publishedDigest(sigUrl)
+			if err != nil {
+				s.err = err
+				return
+			}
+
+			if current != "" {
+				log.Infof("%s is already signed as %s, not signing it again", d, sigUrl)
+				return
+			}
+		}
+
+		s.err = p.publishSignature(is, name, d, sigUrl)
+	})
+	return s.err
+}
+
+// publishSignature publishes a signature of the manifest with digest d, which
+// was published as name, to sigUrl.
+func (p *Publisher) publishSignature(is *types.ImageSource, name string, d digest.Digest, sigUrl string) error {
+	// signatures are identified by the repository they're published to
+	ref := name
+	if is != nil && is.Type == types.DockerLayer {
+		ref = strings.TrimPrefix(fmt.Sprintf("%s/%s", strings.TrimRight(p.opts.Url, "/"), name), "docker://")
+	}
+
+	if err := os.MkdirAll(p.opts.Config.StackerDir, 0755); err != nil {
+		return err
+	}
+
+	dir, err := ioutil.TempDir(p.opts.Config.StackerDir, "publish-sign-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+
+	oci, err := umoci.CreateLayout(dir)
+	if err != nil {
+		return err
+	}
+	defer oci.Close()
+
+	if err := lib.WriteSignature(oci, "signature", ref, d, p.signer); err != nil {
+		return err
+	}
+
+	log.Infof("signing %s as %s", d, sigUrl)
+	_, err = p.imageCopy(fmt.Sprintf("oci:%s:signature", dir), sigUrl, false)
+	return err
+}
+
+// unchanged returns the digest of src's manifest, and whether destUrl
+// already has it. Archives are always written from scratch, so nothing in
+// them is unchanged.
+func (p *Publisher) unchanged(src string, destUrl string) (digest.Digest, bool, error) {
+	d, err := lib.ManifestDigest(lib.ImageCopyOpts{Src: src})
+	if err != nil {
+		return "", false, err
+	}
+
+	if p.archive != nil {
+		return d, false, nil
+	}
+
+	current, err := p.publishedDigest(destUrl)
+	if err != nil {
+		return "", false, err
+	}
+
+	return d, current == d, nil
+}
+
+// publishedDigest returns the digest of the manifest currently published as
+// destUrl, or "" if there isn't one.
+func (p *Publisher) publishedDigest(destUrl string) (digest.Digest, error) {
+	destOpts, err := p.destCopyOpts(destUrl)
+	if err != nil {
+		return "", err
+	}
+
+	current, err := lib.ManifestDigest(lib.ImageCopyOpts{
+		Src:         destUrl,
+		SrcUsername: destOpts.DestUsername,
+		SrcPassword: destOpts.DestPassword,
+		SrcAuthFile: destOpts.DestAuthFile,
+		SkipTLS:     destOpts.DestSkipTLS,
+		SrcCertDir:  destOpts.DestCertDir,
+	})
+	if err != nil {
+		// most likely it just hasn't been published yet; if
+		// something is really wrong, the copy will say so.
+		log.Debugf("couldn't get the current manifest of %s: %v", destUrl, err)
+		return "", nil
+	}
+
+	return current, nil
+}
+
+// imageCopy copies src to destUrl, and returns the digest of the manifest
+// written there.
+func (p *Publisher) imageCopy(src string, destUrl string, allImages bool) (digest.Digest, error) {
+	var progressWriter io.Writer
+	if p.opts.Progress {
+		progressWriter = os.Stderr
+	}
+
+	// archives are written locally, so failures aren't transient (and
+	// docker-archive can't write to the same file twice)
+	if p.archive != nil {
+		copyOpts := lib.ImageCopyOpts{Src: src, Progress: progressWriter, AllImages: allImages}
+		return p.archive.copy(p.opts.Config.StackerDir, copyOpts, destUrl)
+	}
+
+	copyOpts, err := p.destCopyOpts(destUrl)
+	if err != nil {
+		return "", err
+	}
+
+	copyOpts.Src = src
+	copyOpts.Progress = progressWriter
+	copyOpts.AllImages = allImages
+
+	retries := p.opts.Retries
+	for attempt := 0; ; attempt++ {
+		d, err := lib.ImageCopyDigest(copyOpts)
+		if err == nil || attempt >= retries {
+			return d, err
+		}
+
+		delay := retryDelay << uint(attempt)
+		log.Infof("publishing to %s failed, retrying in %s (%d/%d): %v", destUrl, delay, attempt+1, retries, err)
+		time.Sleep(delay)
+	}
+}
+
+// destCopyOpts returns the destination options to publish to destUrl with.
+// TLS is verified unless --dest-tls-verify=false was passed or the
+// destination registry is marked insecure in the config file; --cert-dir
+// overrides the registry's configured cert_dir. Credentials come from
+// --username and --password, or else the registry's configuration, or else
+// the auth file.
+func (p *Publisher) destCopyOpts(destUrl string) (lib.ImageCopyOpts, error) {
+	dest, err := types.NewImageSource(destUrl)
+	if err != nil {
+		return lib.ImageCopyOpts{}, err
+	}
+
+	registry, err := dest.Registry()
+	if err != nil {
+		return lib.ImageCopyOpts{}, err
+	}
+
+	rc := p.opts.Config.Registries[registry]
+
+	opts := lib.ImageCopyOpts{
+		Dest:         destUrl,
+		DestUsername: p.opts.Username,
+		DestPassword: p.opts.Password,
+		DestAuthFile: p.opts.Config.AuthFile,
+		DestSkipTLS:  !p.opts.TLSVerify || rc.Insecure,
+		DestCertDir:  rc.CertDir,
+	}
+
+	if p.opts.CertDir != "" {
+		opts.DestCertDir = p.opts.CertDir
+	}
+
+	if rc.Insecure {
+		log.Infof("not verifying TLS for %s, it is configured as insecure", registry)
+	}
+
+	if opts.DestUsername == "" {
+		opts.DestUsername, opts.DestPassword, err = registryCredentials(rc, registry)
+		if err != nil {
+			return lib.ImageCopyOpts{}, err
+		}
+	}
+
+	return opts, nil
+}
+
 // PublishMultiple published layers defined in a list of stackerfiles
 func (p *Publisher) PublishMultiple(paths []string) error {
 
@@ -162,6 +604,39 @@ func (p *Publisher) PublishMultiple(paths []string) error {
 		return err
 	}
 
+	// Archives are written once everything in them has been published
+	archive, err := parsePublishArchive(p.opts.Url)
+	if err != nil {
+		return err
+	}
+	p.archive = archive
+	if archive != nil {
+		defer archive.cleanup()
+	}
+
+	if p.opts.SignKey != "" {
+		if archive != nil && archive.kind == dockerArchive {
+			return errors.Errorf("docker-archive can't contain signatures, publish to an oci-archive to sign images")
+		}
+
+		p.signer, err = lib.LoadSigningKey(p.opts.SignKey)
+		if err != nil {
+			return err
+		}
+	}
+
+	switch p.opts.LayerType {
+	case "", "tar", "squashfs":
+	default:
+		return errors.Errorf("unknown layer type: %s", p.opts.LayerType)
+	}
+
+	for _, pattern := range p.opts.Layers {
+		if _, err := filepath.Match(pattern, ""); err != nil {
+			return errors.Wrapf(err, "bad --layer %s", pattern)
+		}
+	}
+
 	// Read stackerfiles and update substitutions
 	sfm, err := p.readStackerFiles(paths)
 	if err != nil {
@@ -171,12 +646,52 @@ func (p *Publisher) PublishMultiple(paths []string) error {
 
 	// Publish all Stackerfiles
 	for _, path := range paths {
-		err := p.Publish(path)
+		err := p.queue(path)
 		if err != nil {
 			return err
 		}
 	}
 
+	for _, pattern := range p.opts.Layers {
+		if !p.selected[pattern] {
+			return errors.Errorf("--layer %s doesn't match any layers to publish", pattern)
+		}
+	}
+
+	if p.opts.MultiArch {
+		defer p.deleteIndexTags()
+		if err := p.publishIndexes(); err != nil {
+			return err
+		}
+	}
+
+	if p.archive != nil {
+		if err := p.archive.plan(p.jobs); err != nil {
+			return err
+		}
+	}
+
+	p.runJobs()
+
+	if p.opts.ShowOnly {
+		return nil
+	}
+
+	if p.opts.DigestFile != "" {
+		if err := p.writeDigestFile(); err != nil {
+			return err
+		}
+	}
+
+	// only write archives that have everything in them
+	if err := p.summary(); err != nil {
+		return err
+	}
+
+	if p.archive != nil {
+		return p.archive.write()
+	}
+
 	return nil
 }
 
@@ -186,7 +701,7 @@ func (p *Publisher) PublishMultiple(paths []string) error {
 func (p *Publisher) readStackerFiles(paths []string) (types.StackerFiles, error) {
 
 	// Read all the stacker recipes
-	sfm, err := types.NewStackerFiles(paths, append(p.opts.Substitute, p.opts.Config.Substitutions()...))
+	sfm, err := types.NewStackerFiles(paths, append(p.opts.Substitute, p.opts.Config.Substitutions()...), p.opts.Config)
 	if err != nil {
 
 		// Verify if the error is related to an invalid substitution
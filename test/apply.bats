@@ -74,3 +74,321 @@ function teardown() {
     [ -f dest/rootfs/b ]
     [ "$(cat dest/rootfs/foo)" == "$(printf "hello\n")" ]
 }
+
+@test "apply squashfs layers" {
+    cat > stacker.yaml <<EOF
+a:
+    from:
+        type: docker
+        url: docker://centos:latest
+    run: |
+        touch /a
+        rm /etc/os-release
+        echo "hello" > /foo
+b:
+    from:
+        type: docker
+        url: docker://centos:latest
+    run: |
+        touch /b
+        echo "hello" > /foo
+both:
+    from:
+        type: docker
+        url: docker://centos:latest
+    apply:
+        - oci:oci:a
+        - oci:oci:b
+check:
+    from:
+        type: built
+        tag: both
+    run: |
+        [ -f /a ]
+        [ -f /b ]
+        [ ! -e /etc/os-release ]
+        [ "\$(cat /foo)" == "hello" ]
+EOF
+    stacker build --layer-type squashfs
+    manifest=$(cat oci/index.json | jq -r '.manifests[] | select(.annotations."org.opencontainers.image.ref.name" == "both") | .digest' | cut -f2 -d:)
+    [ -z "$(cat oci/blobs/sha256/$manifest | jq -r '.layers[].mediaType' | grep -v squashfs)" ]
+}
+
+@test "apply_policy resolves conflicts" {
+    cat > stacker.yaml <<EOF
+a:
+    from:
+        type: docker
+        url: docker://centos:latest
+    run: |
+        echo "a" > /foo
+        echo "a" > /bar
+        echo "applied" > /baz
+b:
+    from:
+        type: docker
+        url: docker://centos:latest
+    run: |
+        echo "b" > /foo
+        echo "b" > /bar
+        echo "base" > /baz
+both:
+    from:
+        type: built
+        tag: b
+    apply:
+        - oci:oci:a
+    apply_policy:
+        /foo: union-lines
+        /ba?: prefer-applied
+        /bar: prefer-base
+EOF
+    stacker build
+    umoci unpack --image oci:both dest
+    [ "$(cat dest/rootfs/foo)" == "$(printf "b\na\n")" ]
+    [ "$(cat dest/rootfs/bar)" == "b" ]
+    [ "$(cat dest/rootfs/baz)" == "applied" ]
+}
+
+@test "apply_policy fail rejects differing files" {
+    cat > stacker.yaml <<EOF
+a:
+    from:
+        type: docker
+        url: docker://centos:latest
+    run: |
+        echo "a" > /foo
+b:
+    from:
+        type: built
+        tag: a
+    run: |
+        echo "b" >> /foo
+both:
+    from:
+        type: built
+        tag: a
+    apply:
+        - oci:oci:b
+    apply_policy:
+        default: fail
+EOF
+    bad_stacker build
+    [[ "$output" =~ "foo differs from the existing file" ]]
+}
+
+@test "--apply-dry-run reports all conflicts" {
+    cat > stacker.yaml <<EOF
+a:
+    from:
+        type: docker
+        url: docker://centos:latest
+    run: |
+        echo "a" > /foo
+        ln -s /a /link
+b:
+    from:
+        type: docker
+        url: docker://centos:latest
+    run: |
+        echo "b" > /foo
+        ln -s /b /link
+c:
+    from:
+        type: docker
+        url: docker://centos:latest
+    run: |
+        head -c 1024 /dev/urandom > /foo
+both:
+    from:
+        type: built
+        tag: a
+    apply:
+        - oci:oci:b
+        - oci:oci:c
+    apply_policy:
+        default: fail
+after:
+    from:
+        type: built
+        tag: both
+    run: touch /after
+EOF
+    bad_stacker build --apply-dry-run
+    echo "$output" | grep "apply dry run found 3 conflicts"
+    echo "$output" | grep "oci:oci:b: link would change symlink"
+    echo "$output" | grep "oci:oci:b: foo differs from the existing file"
+    echo "$output" | grep "oci:oci:c: foo differs from the existing file"
+    echo "$output" | grep "skipping after"
+    [ -z "$(umoci ls --layout oci | grep both)" ]
+}
+
+@test "--apply-dry-run checks cached layers" {
+    cat > stacker.yaml <<EOF
+a:
+    from:
+        type: docker
+        url: docker://centos:latest
+    run: echo "a" > /foo
+b:
+    from:
+        type: docker
+        url: docker://centos:latest
+    run: echo "a" > /foo
+both:
+    from:
+        type: built
+        tag: a
+    apply:
+        - oci:oci:b
+    apply_policy:
+        default: fail
+EOF
+    stacker build
+
+    # b changes, but both (which only applies it from the oci layout) is
+    # still cached
+    sed -i -e '/^b:/,/^both:/ s/echo "a"/echo "b"/' stacker.yaml
+    bad_stacker build --apply-dry-run
+    echo "$output" | grep "apply dry run found 1 conflicts"
+    echo "$output" | grep "oci:oci:b: foo differs from the existing file"
+}
+
+@test "--apply-dry-run reports the conflicts of every stackerfile" {
+    cat > base.yaml <<EOF
+a:
+    from:
+        type: docker
+        url: docker://centos:latest
+    run: echo "a" > /foo
+b:
+    from:
+        type: docker
+        url: docker://centos:latest
+    run: echo "b" > /foo
+EOF
+    for n in one two; do
+        cat > $n.yaml <<EOF
+config:
+    prerequisites:
+        - base.yaml
+$n:
+    from:
+        type: built
+        tag: a
+    apply:
+        - oci:oci:b
+    apply_policy:
+        default: fail
+EOF
+    done
+    bad_stacker recursive-build -d . -p '.*\.yaml' --apply-dry-run
+    echo "$output" | grep "apply dry run found 2 conflicts"
+}
+
+@test "apply_config merges applied image configs" {
+    cat > stacker.yaml <<EOF
+a:
+    from:
+        type: docker
+        url: docker://centos:latest
+    run: touch /a
+    environment:
+        FOO: a
+    labels:
+        from.a: yes
+    volumes:
+        - /data
+    entrypoint: /bin/a
+both:
+    from:
+        type: docker
+        url: docker://centos:latest
+    apply:
+        - oci:oci:a
+    apply_config: all
+EOF
+    stacker build
+    manifest=$(cat oci/index.json | jq -r '.manifests[] | select(.annotations."org.opencontainers.image.ref.name" == "both") | .digest' | cut -f2 -d:)
+    config=$(cat oci/blobs/sha256/$manifest | jq -r .config.digest | cut -f2 -d:)
+    cat oci/blobs/sha256/$config | jq -r '.config.Env[]' | grep "^FOO=a$"
+    [ "$(cat oci/blobs/sha256/$config | jq -r '.config.Labels."from.a"')" == "yes" ]
+    [ "$(cat oci/blobs/sha256/$config | jq -r '.config.Volumes | keys[0]')" == "/data" ]
+    [ "$(cat oci/blobs/sha256/$config | jq -r '.config.Entrypoint[0]')" == "/bin/a" ]
+    cat oci/blobs/sha256/$config | jq -r '.history[].comment' | grep "merged env, labels, volumes, entrypoint from oci:oci:a"
+}
+
+@test "apply_config conflicts" {
+    cat > stacker.yaml <<EOF
+a:
+    from:
+        type: docker
+        url: docker://centos:latest
+    run: touch /a
+    environment:
+        FOO: a
+b:
+    from:
+        type: docker
+        url: docker://centos:latest
+    run: touch /b
+    environment:
+        FOO: b
+both:
+    from:
+        type: docker
+        url: docker://centos:latest
+    apply:
+        - oci:oci:a
+        - oci:oci:b
+    apply_config: env
+EOF
+    bad_stacker build
+    [[ "$output" =~ "apply_config: oci:oci:b sets FOO=b, but it is already FOO=a" ]]
+
+    # the layer's own environment resolves the conflict
+    cat >> stacker.yaml <<EOF
+    environment:
+        FOO: both
+EOF
+    stacker build
+    manifest=$(cat oci/index.json | jq -r '.manifests[] | select(.annotations."org.opencontainers.image.ref.name" == "both") | .digest' | cut -f2 -d:)
+    config=$(cat oci/blobs/sha256/$manifest | jq -r .config.digest | cut -f2 -d:)
+    cat oci/blobs/sha256/$config | jq -r '.config.Env[]' | grep "^FOO=both$"
+}
+
+@test "apply layers from the same stackerfile" {
+    cat > stacker.yaml <<EOF
+both:
+    from:
+        type: docker
+        url: docker://centos:latest
+    apply:
+        - stacker://a
+        - built:b
+a:
+    from:
+        type: docker
+        url: docker://centos:latest
+    run: touch /a
+b:
+    from:
+        type: docker
+        url: docker://centos:latest
+    run: touch /b
+EOF
+    stacker build
+    umoci unpack --image oci:both dest
+    [ -f dest/rootfs/a ]
+    [ -f dest/rootfs/b ]
+
+    # rebuilding a means both is rebuilt too
+    stacker build
+    echo "$output" | grep "found cached layer both"
+    sed -i -e 's|touch /a|touch /a2|' stacker.yaml
+    stacker build
+    echo "$output" | grep "cache miss because base layer was changed"
+    rm -rf dest
+    umoci unpack --image oci:both dest
+    [ -f dest/rootfs/a2 ]
+}
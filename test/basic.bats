@@ -113,3 +113,22 @@ EOF
     [ ! -f dest/rootfs/favicon.ico ]
     [ ! -d dest/rootfs/stacker ]
 }
+
+@test "compressed tar bases" {
+    mkdir -p .stacker/layer-bases
+    skopeo --insecure-policy copy docker://centos:latest oci:.stacker/layer-bases/oci:centos
+    umoci unpack --image .stacker/layer-bases/oci:centos dest
+    for c in xz zstd bzip2; do
+        tar -C dest/rootfs -cf - . | $c > centos.tar.$c
+        cat > stacker.yaml <<EOF
+centos:
+    from:
+        type: tar
+        url: centos.tar.$c
+    run: ls /etc/centos-release
+EOF
+        stacker build
+        stacker clean
+    done
+    rm -rf dest centos.tar.*
+}
@@ -58,3 +58,37 @@ EOF
     [ -f favicon.ico ]
     [ "$(sha favicon.ico)" == "$(sha .stacker/imports/centos/favicon.ico)" ]
 }
+
+@test "apply onto build only base" {
+    cat > stacker.yaml <<EOF
+bundle:
+    from:
+        type: docker
+        url: docker://centos:latest
+    run: |
+        echo bundle > /bundle
+toolchain:
+    from:
+        type: docker
+        url: docker://centos:latest
+    run: |
+        echo toolchain > /toolchain
+    build_only: true
+runtime:
+    from:
+        type: built
+        tag: toolchain
+    apply:
+        - oci:oci:bundle
+EOF
+    stacker build
+    echo "$output" | grep "applying layer" | wc -l | grep "^1$"
+    umoci unpack --image oci:runtime dest
+    [ "$(cat dest/rootfs/bundle)" == "bundle" ]
+    [ "$(cat dest/rootfs/toolchain)" == "toolchain" ]
+
+    # the centos layer is shared, and the toolchain and bundle changes end
+    # up in a new layer
+    manifest=$(cat oci/index.json | jq -r '.manifests[] | select(.annotations."org.opencontainers.image.ref.name" == "runtime") | .digest' | cut -f2 -d:)
+    [ "$(cat oci/blobs/sha256/$manifest | jq -r '.layers | length')" == "2" ]
+}
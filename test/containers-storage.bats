@@ -0,0 +1,54 @@
+load helpers
+
+function setup() {
+    stacker_setup
+    command -v podman || skip "podman not installed"
+    podman pull docker.io/library/centos:latest
+    podman tag docker.io/library/centos:latest localhost/stacker-test-centos:latest
+}
+
+function teardown() {
+    cleanup
+    podman rmi localhost/stacker-test-centos:latest || true
+}
+
+@test "containers-storage bases" {
+    cat > stacker.yaml <<EOF
+centos:
+    from:
+        type: containers-storage
+        url: localhost/stacker-test-centos:latest
+    run: ls /etc/centos-release
+EOF
+    stacker build
+    umoci unpack --image oci:centos dest
+    [ -f dest/rootfs/etc/centos-release ]
+}
+
+@test "containers-storage apply" {
+    cat > stacker.yaml <<EOF
+centos:
+    from:
+        type: docker
+        url: docker://centos:latest
+    apply:
+        - containers-storage:localhost/stacker-test-centos:latest
+EOF
+    stacker build
+}
+
+@test "containers-storage bases are local" {
+    cat > stacker.yaml <<EOF
+centos:
+    from:
+        type: containers-storage
+        url: localhost/stacker-test-centos:latest
+    run: ls /etc/centos-release
+EOF
+    stacker --offline build
+    stacker lock
+    [ -f stacker.lock ]
+    run grep "stacker-test-centos" stacker.lock
+    [ "$status" -ne 0 ]
+    stacker build
+}
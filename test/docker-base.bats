@@ -30,3 +30,33 @@ EOF
     umoci unpack --image oci:layer1 dest
     [ ! -f dest/rootfs/favicon.ico ]
 }
+
+@test "digest pinned bases and apply images" {
+    digest=$(skopeo inspect docker://centos:latest | jq -r .Digest)
+    alpine=$(skopeo inspect docker://alpine:latest | jq -r .Digest)
+    cat > stacker.yaml <<EOF
+centos:
+    from:
+        type: docker
+        url: docker://centos:latest@$digest
+    apply:
+        - docker://alpine@$alpine
+EOF
+    stacker build
+    [ "$(cat .stacker/layer-bases/oci/index.json | jq -r '.manifests[].annotations["com.cisco.stacker.source_digest"]' | grep -c "$digest")" == "1" ]
+
+    # pinned images are immutable, so there's no need to pull them again
+    stacker clean
+    stacker build
+    [[ "$output" =~ "using cached copy of docker://centos:latest@$digest" ]]
+}
+
+@test "bases that don't match their pinned digest fail" {
+    cat > stacker.yaml <<EOF
+centos:
+    from:
+        type: docker
+        url: docker://centos@sha256:0000000000000000000000000000000000000000000000000000000000000000
+EOF
+    bad_stacker build
+}
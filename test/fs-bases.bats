@@ -0,0 +1,73 @@
+load helpers
+
+function setup() {
+    stacker_setup
+    mkdir -p base/etc
+    echo "appliance" > base/etc/release
+}
+
+function teardown() {
+    cleanup
+    rm -rf base base.squashfs sub || true
+}
+
+@test "dir bases" {
+    cat > stacker.yaml <<EOF
+appliance:
+    from:
+        type: dir
+        url: base
+    run: |
+        [ "\$(cat /etc/release)" == "appliance" ]
+EOF
+    stacker build
+    umoci unpack --image oci:appliance dest
+    [ "$(cat dest/rootfs/etc/release)" == "appliance" ]
+
+    stacker build
+    [[ "$output" =~ "found cached layer appliance" ]]
+
+    # changing the dir's content invalidates the cache
+    echo "appliance 2" > base/etc/release
+    stacker build
+    [[ ! "$output" =~ "found cached layer appliance" ]]
+}
+
+@test "dir bases are relative to the stackerfile" {
+    mkdir -p sub
+    mv base sub/base
+    cat > sub/stacker.yaml <<EOF
+appliance:
+    from:
+        type: dir
+        url: base
+EOF
+    stacker build -f sub/stacker.yaml
+    umoci unpack --image oci:appliance dest
+    [ "$(cat dest/rootfs/etc/release)" == "appliance" ]
+}
+
+@test "squashfs bases" {
+    mksquashfs base base.squashfs
+    cat > stacker.yaml <<EOF
+appliance:
+    from:
+        type: squashfs
+        url: base.squashfs
+    run: |
+        [ "\$(cat /etc/release)" == "appliance" ]
+EOF
+    stacker build
+    umoci unpack --image oci:appliance dest
+    [ "$(cat dest/rootfs/etc/release)" == "appliance" ]
+}
+
+@test "dir and squashfs bases need a url" {
+    cat > stacker.yaml <<EOF
+appliance:
+    from:
+        type: dir
+EOF
+    bad_stacker build
+    [[ "$output" =~ "from url cannot be empty" ]]
+}
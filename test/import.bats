@@ -6,7 +6,7 @@ function setup() {
 
 function teardown() {
     cleanup
-    rm -rf recursive bing.ico || true
+    rm -rf recursive bing.ico extras extras.tar.* || true
 }
 
 @test "different URLs with same base get re-imported" {
@@ -72,3 +72,37 @@ EOF
 
     stacker build
 }
+
+@test "extract: true unpacks imported archives into the rootfs" {
+    mkdir -p extras/opt/extras
+    echo hello > extras/opt/extras/hello
+    tar -C extras -cJf extras.tar.xz opt
+    cat > stacker.yaml <<EOF
+thing:
+    from:
+        type: docker
+        url: docker://centos:latest
+    import:
+        - path: extras.tar.xz
+          extract: true
+    run: |
+        [ "\$(cat /opt/extras/hello)" == "hello" ]
+        [ -f /stacker/extras.tar.xz ]
+EOF
+    stacker build
+    umoci unpack --image oci:thing dest
+    [ "$(cat dest/rootfs/opt/extras/hello)" == "hello" ]
+}
+
+@test "bad import entries are rejected" {
+    cat > stacker.yaml <<EOF
+thing:
+    from:
+        type: scratch
+    import:
+        - path: extras.tar.xz
+          extrakt: true
+EOF
+    bad_stacker build
+    [[ "$output" =~ "unknown import key extrakt" ]]
+}
@@ -0,0 +1,116 @@
+load helpers
+
+function setup() {
+    stacker_setup
+    cat > stacker.yaml <<EOF
+centos:
+    from:
+        type: docker
+        url: docker://centos:latest
+    import:
+        - https://www.cisco.com/favicon.ico
+EOF
+}
+
+function teardown() {
+    cleanup
+}
+
+@test "stacker lock records inputs" {
+    stacker lock
+    [ -f stacker.lock ]
+    grep "docker://centos:latest: sha256:" stacker.lock
+    grep "https://www.cisco.com/favicon.ico: sha256:$(sha .stacker/imports/centos/favicon.ico)" stacker.lock
+    stacker build
+}
+
+@test "stacker lock records digest pinned bases" {
+    pinned=$(skopeo inspect docker://centos:latest | jq -r .Digest)
+    cat > stacker.yaml <<EOF
+centos:
+    from:
+        type: docker
+        url: docker://centos:latest@$pinned
+EOF
+    stacker lock
+    grep "docker://centos:latest@$pinned: $pinned" stacker.lock
+    stacker build
+}
+
+@test "builds fail when inputs drift from the lock" {
+    stacker lock
+    stacker build
+    sed -i -e 's|\(docker://centos:latest: sha256:\).*|\10000000000000000000000000000000000000000000000000000000000000000|' stacker.lock
+
+    # the cached copy can't be re-pulled, so it's checked against the lock
+    bad_stacker build --pull never
+    [[ "$output" =~ "drifted" ]]
+    [[ "$output" =~ "docker://centos:latest" ]]
+
+    # otherwise the locked digest is pulled, which doesn't exist
+    bad_stacker build
+    [[ "$output" =~ "centos@sha256:0000000000000000000000000000000000000000000000000000000000000000" ]]
+}
+
+@test "locked images are pulled by their locked digest" {
+    stacker lock
+    # pretend centos:latest has moved on since it was locked
+    old=$(skopeo inspect docker://centos:7 | jq -r .Digest)
+    sed -i -e "s|\(docker://centos:latest: \).*|\1$old|" stacker.lock
+    stacker build
+    [[ "$output" =~ "loading docker://docker.io/library/centos@$old" ]]
+    [ "$(cat .stacker/layer-bases/oci/index.json | jq -r '.manifests[].annotations["com.cisco.stacker.source_digest"]')" == "$old" ]
+
+    # it's still the locked digest that's cached after a clean
+    stacker clean
+    stacker build
+    [[ "$output" =~ "using cached copy of docker://centos:latest" ]]
+}
+
+@test "builds fail on inputs missing from the lock" {
+    stacker lock
+    cat > stacker.yaml <<EOF
+centos:
+    from:
+        type: docker
+        url: docker://centos:latest
+    apply:
+        - docker://alpine:latest
+EOF
+    bad_stacker build
+    [[ "$output" =~ "docker://alpine:latest is not in" ]]
+}
+
+@test "--update-lock accepts new inputs" {
+    stacker build --update-lock
+    grep "docker://centos:latest: sha256:" stacker.lock
+    grep "https://www.cisco.com/favicon.ico: sha256:" stacker.lock
+    stacker clean
+    stacker build
+}
+
+@test "prefetch pulls locked images by their locked digest" {
+    stacker lock
+    old=$(skopeo inspect docker://centos:7 | jq -r .Digest)
+    sed -i -e "s|\(docker://centos:latest: \).*|\1$old|" stacker.lock
+    stacker prefetch
+    [[ "$output" =~ "loading docker://docker.io/library/centos@$old" ]]
+    stacker build --pull never
+}
+
+@test "stackerfiles in the same directory have their own lockfiles" {
+    cat > other.yaml <<EOF
+alpine:
+    from:
+        type: docker
+        url: docker://alpine:latest
+EOF
+    stacker lock -d . -p '.*\.yaml'
+    grep "docker://centos:latest" stacker.lock
+    run grep "docker://alpine:latest" stacker.lock
+    [ "$status" -ne 0 ]
+    grep "docker://alpine:latest" other.lock
+    run grep "docker://centos:latest" other.lock
+    [ "$status" -ne 0 ]
+    stacker recursive-build -d . -p '.*\.yaml'
+}
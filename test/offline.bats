@@ -0,0 +1,76 @@
+load helpers
+
+function setup() {
+    stacker_setup
+    cat > stacker.yaml <<EOF
+centos:
+    from:
+        type: docker
+        url: docker://centos:latest
+    import:
+        - https://www.cisco.com/favicon.ico
+    run: |
+        cp /stacker/favicon.ico /favicon.ico
+EOF
+}
+
+function teardown() {
+    cleanup
+    ip netns del stacker-test || true
+}
+
+@test "offline builds use cached inputs" {
+    stacker build
+    stacker clean
+
+    # no network at all: everything must come out of .stacker
+    ip netns add stacker-test
+    run ip netns exec stacker-test "${ROOT_DIR}/stacker" --storage-type=$STORAGE_TYPE --offline build
+    echo "$output"
+    [ "$status" -eq 0 ]
+    [[ "$output" =~ "offline, using cached copy of docker://centos:latest" ]]
+
+    umoci unpack --image oci:centos dest
+    [ "$(sha .stacker/imports/centos/favicon.ico)" == "$(sha dest/rootfs/favicon.ico)" ]
+}
+
+@test "offline builds report all missing inputs" {
+    cat > stacker.yaml <<EOF
+centos:
+    from:
+        type: docker
+        url: docker://centos:latest
+    import:
+        - https://www.cisco.com/favicon.ico
+    apply:
+        - docker://ubuntu:latest
+EOF
+    bad_stacker --offline build
+    [[ "$output" =~ "needs network" ]]
+    [[ "$output" =~ "docker://centos:latest" ]]
+    [[ "$output" =~ "docker://ubuntu:latest" ]]
+    [[ "$output" =~ "https://www.cisco.com/favicon.ico" ]]
+    [ ! -d roots/centos ]
+}
+
+@test "offline builds fail on uncached remote stackerfiles" {
+    bad_stacker --offline build -f https://example.com/stacker.yaml
+    [[ "$output" =~ "needs network" ]]
+    [[ "$output" =~ "https://example.com/stacker.yaml" ]]
+}
+
+@test "offline builds report uncached stackerfiles with other missing inputs" {
+    cat > stacker.yaml <<EOF
+config:
+    prerequisites:
+        - https://example.com/stacker.yaml
+centos:
+    from:
+        type: docker
+        url: docker://centos:latest
+EOF
+    bad_stacker --offline build
+    [[ "$output" =~ "needs network" ]]
+    [[ "$output" =~ "https://example.com/stacker.yaml" ]]
+    [[ "$output" =~ "docker://centos:latest" ]]
+}
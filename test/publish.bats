@@ -75,7 +75,7 @@ EOF
 function teardown() {
     cleanup
     rm -rf ocibuilds || true
-    rm -rf oci_publish || true
+    rm -rf oci_publish oci_unsigned || true
 }
 
 
@@ -125,9 +125,263 @@ function teardown() {
 
 }
 
+@test "publish to archives" {
+    stacker recursive-build -d ocibuilds
+    stacker publish -d ocibuilds --url oci-archive:publish.tar --tag test1 --tag test2 --show-only
+    [[ "$output" =~ "would publish: ocibuilds/sub1/stacker.yaml layer1 to oci-archive:publish.tar:layer1_test2" ]]
+    [ ! -f publish.tar ]
+
+    stacker publish -d ocibuilds --url oci-archive:publish.tar --tag test1 --tag test2
+    mkdir oci_archive
+    tar -C oci_archive -xf publish.tar
+    umoci unpack --image oci_archive:layer1_test1 dest/layer1_test1
+    [ -f dest/layer1_test1/rootfs/root/import1 ]
+    umoci unpack --image oci_archive:layer2_test2 dest/layer2_test2
+    [ -f dest/layer2_test2/rootfs/root/import2 ]
+    umoci unpack --image oci_archive:layer6_test1 dest/layer6_test1
+    [ -f dest/layer6_test1/rootfs/root/ls_out ]
+    rm -rf oci_archive
+
+    # docker-archive only holds one image
+    bad_stacker publish -d ocibuilds --url docker-archive:publish.tar --tag test1 --tag test2
+    [[ "$output" =~ "can't both be published to one docker-archive, publish them to an oci-archive instead" ]]
+
+    stacker publish -d ocibuilds --url docker-archive:publish.tar --layer layer1 --tag test1 --tag test2
+    tar -xOf publish.tar manifest.json | jq -r '.[].RepoTags[]' | sort > tags
+    grep -x "docker.io/library/layer1:test1" tags
+    grep -x "docker.io/library/layer1:test2" tags
+    [ "$(tar -xOf publish.tar manifest.json | jq -r 'length')" == "1" ]
+
+    # the staged images are cleaned up
+    [ -z "$(ls .stacker | grep publish-archive)" ]
+    [ -z "$(ls | grep publish.tar.tmp)" ]
+}
+
+@test "publish signed images" {
+    openssl ecparam -name prime256v1 -genkey -noout -out sign.key
+    openssl ec -in sign.key -pubout -out sign.pub
+    openssl ecparam -name prime256v1 -genkey -noout -out other.key
+    openssl ec -in other.key -pubout -out other.pub
+
+    stacker build -f ocibuilds/sub1/stacker.yaml
+    stacker publish -f ocibuilds/sub1/stacker.yaml --url oci:oci_publish --tag test1 --tag test2 --sign-key sign.key
+
+    digest=$(cat oci_publish/index.json | jq -r '.manifests[] | select(.annotations."org.opencontainers.image.ref.name" == "layer1_test1") | .digest' | cut -f2 -d:)
+    umoci ls --layout oci_publish | grep -x "sha256-$digest.sig"
+    [ "$(umoci ls --layout oci_publish | grep -c '\.sig$')" == "1" ]
+
+    stacker verify --layout oci_publish --key sign.pub
+    [[ "$output" =~ "layer1_test1: verified sha256:$digest" ]]
+    [[ "$output" =~ "layer1_test2: verified sha256:$digest" ]]
+
+    bad_stacker verify --layout oci_publish --key other.pub layer1_test1
+    [[ "$output" =~ "layer1_test1: FAILED" ]]
+
+    # unchanged images that are already signed aren't signed again
+    sig=$(cat oci_publish/index.json | jq -r ".manifests[] | select(.annotations.\"org.opencontainers.image.ref.name\" == \"sha256-$digest.sig\") | .digest")
+    stacker publish -f ocibuilds/sub1/stacker.yaml --url oci:oci_publish --tag test1 --tag test2 --sign-key sign.key
+    [[ "$output" =~ "sha256:$digest is already signed" ]]
+    [ "$(cat oci_publish/index.json | jq -r ".manifests[] | select(.annotations.\"org.opencontainers.image.ref.name\" == \"sha256-$digest.sig\") | .digest")" == "$sig" ]
+
+    # images without signatures don't verify either
+    stacker publish -f ocibuilds/sub1/stacker.yaml --url oci:oci_unsigned --tag test1
+    bad_stacker verify --layout oci_unsigned --key sign.pub
+    [[ "$output" =~ "no signature for" ]]
+
+    bad_stacker publish -f ocibuilds/sub1/stacker.yaml --url docker-archive:publish.tar --tag test1 --sign-key sign.key
+    [[ "$output" =~ "docker-archive can't contain signatures" ]]
+}
+
+@test "publish digest file and unchanged images" {
+    stacker recursive-build -d ocibuilds
+    stacker publish -d ocibuilds --url oci:oci_publish --tag test1 --tag test2 --digest-file digests.json
+    [ "$(jq -r 'length' digests.json)" == "8" ]
+    [ "$(jq -r '[.[] | select(.unchanged)] | length' digests.json)" == "0" ]
+
+    layer1=$(cat oci_publish/index.json | jq -r '.manifests[] | select(.annotations."org.opencontainers.image.ref.name" == "layer1_test2") | .digest')
+    [ "$(jq -r '.[] | select(.name == "layer1" and .tag == "test2") | .digest' digests.json)" == "$layer1" ]
+    [ "$(jq -r '.[] | select(.name == "layer1" and .tag == "test2") | .destination' digests.json)" == "oci:oci_publish:layer1_test2" ]
+    [ "$(jq -r '.[] | select(.name == "layer1" and .tag == "test2") | .layers[0]' digests.json)" == "layer1" ]
+
+    # nothing changed, so nothing is published again
+    stacker publish -d ocibuilds --url oci:oci_publish --tag test1 --tag test2 --digest-file digests.json
+    [[ "$output" =~ "ocibuilds/sub1/stacker.yaml layer1 is already published to oci:oci_publish:layer1_test1" ]]
+    [ "$(jq -r '[.[] | select(.unchanged)] | length' digests.json)" == "8" ]
+    [ "$(jq -r '.[] | select(.name == "layer1" and .tag == "test2") | .digest' digests.json)" == "$layer1" ]
+
+    # a new tag is published, the rest are skipped
+    stacker publish -d ocibuilds --url oci:oci_publish --tag test1 --tag test3 --digest-file digests.json
+    [ "$(jq -r '[.[] | select(.unchanged)] | length' digests.json)" == "4" ]
+    [ "$(jq -r '[.[] | select(.tag == "test3" and (.unchanged | not))] | length' digests.json)" == "4" ]
+    umoci ls --layout oci_publish | grep -x layer1_test3
+}
+
+@test "publish with name and tag templates" {
+    cat > stacker.yaml <<EOF
+foo:
+    from:
+        type: docker
+        url: docker://centos:latest
+    labels:
+        team: core
+bar:
+    from:
+        type: docker
+        url: docker://centos:latest
+    publish:
+        name: \${{PREFIX}}-renamed
+        tag: "{{.Tag}}-{{.Substitutions.PREFIX}}"
+EOF
+    git init .
+    git add stacker.yaml
+    git -c user.name=test -c user.email=test@example.com commit -m "stacker.yaml"
+    git tag v2.0
+    stacker build --substitute PREFIX=prod
+    stacker publish --substitute PREFIX=prod --url docker://docker-reg.fake.com/ --tag test1 --tag test2 --show-only \
+        --name-template '{{.Labels.team}}/{{.Layer}}' --tag-template 'v1-{{.Tag}}'
+    [[ "$output" =~ "would publish: stacker.yaml foo to docker://docker-reg.fake.com/core/foo:v1-test1" ]]
+    [[ "$output" =~ "would publish: stacker.yaml foo to docker://docker-reg.fake.com/core/foo:v1-test2" ]]
+    [[ "$output" =~ "would publish: stacker.yaml bar to docker://docker-reg.fake.com/prod-renamed:test1-prod" ]]
+
+    # tag templates that ignore the tag are only published once
+    stacker publish --substitute PREFIX=prod --url oci:oci_publish --tag test1 --tag test2 --tag-template '{{.GitVersion}}'
+    [ "$(umoci ls --layout oci_publish | grep -c foo_)" == "1" ]
+    umoci ls --layout oci_publish | grep -x "foo_v2.0"
+    umoci ls --layout oci_publish | grep -x "prod-renamed_test1-prod"
+
+    bad_stacker publish --substitute PREFIX=prod --url oci:oci_publish --tag test1 --name-template '{{.Labels.missing}}'
+    [[ "$output" =~ "couldn't render publish name for foo" ]]
+}
+
+@test "publish selected layers with a summary" {
+    stacker recursive-build -d ocibuilds
+    stacker publish -d ocibuilds --url oci:oci_publish --tag test1 --layer 'layer[12]' --layer layer6 --jobs 4
+    [[ "$output" =~ "only registries can be published to concurrently" ]]
+    [[ "$output" =~ "publish summary: 3 succeeded, 0 skipped (unchanged), 0 failed" ]]
+    umoci ls --layout oci_publish | grep -x layer1_test1
+    umoci ls --layout oci_publish | grep -x layer2_test1
+    umoci ls --layout oci_publish | grep -x layer6_test1
+    [ -z "$(umoci ls --layout oci_publish | grep layer4)" ]
+
+    stacker publish -d ocibuilds --url oci:oci_publish --tag test1 --tag test2 --layer 'layer1'
+    [[ "$output" =~ "publish summary: 1 succeeded, 1 skipped (unchanged), 0 failed" ]]
+    [[ "$output" =~ "skipped: ocibuilds/sub1/stacker.yaml layer1 to oci:oci_publish:layer1_test1" ]]
+
+    bad_stacker publish -d ocibuilds --url oci:oci_publish --tag test1 --layer 'nope*'
+    [[ "$output" =~ "--layer nope* doesn't match any layers to publish" ]]
+
+    # failures are retried, and don't stop the rest from being published
+    bad_stacker publish -d ocibuilds --url docker://localhost:1/ --tag test1 --layer 'layer[12]' --retries 1 --jobs 2
+    [[ "$output" =~ "retrying in 1s (1/1)" ]]
+    [[ "$output" =~ "publish summary: 0 succeeded, 0 skipped (unchanged), 2 failed" ]]
+    [[ "$output" =~ "failed: ocibuilds/sub1/stacker.yaml layer1 to docker://localhost:1/layer1:test1" ]]
+    [[ "$output" =~ "2 of 2 pushes failed" ]]
+}
+
+@test "publish with a different layer type" {
+    stacker build -f ocibuilds/sub4/stacker.yaml
+    stacker publish -f ocibuilds/sub4/stacker.yaml --url oci:oci_publish --tag tar --tag squashfs --layer-type squashfs
+    [[ "$output" =~ "converting layer4 to squashfs layers" ]]
+
+    manifest=$(cat oci_publish/index.json | jq -r '.manifests[] | select(.annotations."org.opencontainers.image.ref.name" == "layer4_squashfs") | .digest' | cut -f2 -d:)
+    [ "$(cat oci_publish/blobs/sha256/$manifest | jq -r '.layers | length')" == "1" ]
+    [ "$(cat oci_publish/blobs/sha256/$manifest | jq -r .layers[0].mediaType)" == "application/vnd.oci.image.layer.squashfs" ]
+    layer=$(cat oci_publish/blobs/sha256/$manifest | jq -r .layers[0].digest)
+    config=$(cat oci_publish/blobs/sha256/$manifest | jq -r .config.digest | cut -f2 -d:)
+    [ "$(cat oci_publish/blobs/sha256/$config | jq -r '.rootfs.diff_ids | length')" == "1" ]
+    [ "$(cat oci_publish/blobs/sha256/$config | jq -r '.rootfs.diff_ids[0]')" == "$layer" ]
+    [ "$(cat oci_publish/blobs/sha256/$config | jq -r '[.history[] | select(.empty_layer | not)] | length')" == "1" ]
+    [ "$(cat oci_publish/blobs/sha256/$config | jq -r '.history[-1].created_by')" == "stacker publish --layer-type squashfs repack of layer4" ]
+
+    mkdir layer4
+    mount -t squashfs oci_publish/blobs/sha256/${layer#sha256:} layer4
+    [ -f layer4/root/ls_out ]
+    umount layer4
+
+    # the converted image is cached, so it isn't converted or published again
+    stacker publish -f ocibuilds/sub4/stacker.yaml --url oci:oci_publish --tag squashfs --layer-type squashfs
+    [[ ! "$output" =~ "converting layer4" ]]
+    [[ "$output" =~ "publish summary: 0 succeeded, 1 skipped (unchanged), 0 failed" ]]
+
+    # layers that are already the right type are published as they are
+    stacker publish -f ocibuilds/sub4/stacker.yaml --url oci:oci_publish --tag tar --layer-type tar
+    [[ ! "$output" =~ "converting layer4" ]]
+    built=$(cat oci/index.json | jq -r '.manifests[] | select(.annotations."org.opencontainers.image.ref.name" == "layer4") | .digest' | cut -f2 -d:)
+    manifest=$(cat oci_publish/index.json | jq -r '.manifests[] | select(.annotations."org.opencontainers.image.ref.name" == "layer4_tar") | .digest' | cut -f2 -d:)
+    [ "$(cat oci_publish/blobs/sha256/$manifest | jq -c '[.layers[].digest]')" == "$(cat oci/blobs/sha256/$built | jq -c '[.layers[].digest]')" ]
+
+    bad_stacker publish -f ocibuilds/sub4/stacker.yaml --url oci:oci_publish --tag tar --layer-type zip
+    [[ "$output" =~ "unknown layer type: zip" ]]
+
+    # conversions of older builds of a layer don't pile up
+    stacker build -f ocibuilds/sub4/stacker.yaml --no-cache
+    stacker publish -f ocibuilds/sub4/stacker.yaml --url oci:oci_publish --tag squashfs --layer-type squashfs
+    [[ "$output" =~ "converting layer4 to squashfs layers" ]]
+    [ "$(umoci ls --layout .stacker/publish-layer-types/oci | grep -c '^squashfs_')" == "1" ]
+
+    stacker clean
+    [ ! -d .stacker/publish-layer-types ]
+}
+
+@test "publish squashfs builds as tar" {
+    require_storage btrfs # FIXME: overlay can't unpack squashfs
+    stacker build -f ocibuilds/sub4/stacker.yaml --layer-type squashfs
+    stacker publish -f ocibuilds/sub4/stacker.yaml --url oci:oci_publish --tag test1 --layer-type tar
+    [[ "$output" =~ "converting layer4 to tar layers" ]]
+
+    manifest=$(cat oci_publish/index.json | jq -r .manifests[0].digest | cut -f2 -d:)
+    [ "$(cat oci_publish/blobs/sha256/$manifest | jq -r .layers[0].mediaType)" == "application/vnd.oci.image.layer.v1.tar+gzip" ]
+    layer=$(cat oci_publish/blobs/sha256/$manifest | jq -r .layers[0].digest | cut -f2 -d:)
+    config=$(cat oci_publish/blobs/sha256/$manifest | jq -r .config.digest | cut -f2 -d:)
+    [ "$(cat oci_publish/blobs/sha256/$config | jq -r '.rootfs.diff_ids[0]')" == "sha256:$(zcat oci_publish/blobs/sha256/$layer | sha256sum | cut -f1 -d' ')" ]
+
+    umoci unpack --image oci_publish:layer4_test1 dest
+    [ -f dest/rootfs/root/ls_out ]
+}
+
 @test "do not publish build only layer" {
     stacker build -f ocibuilds/sub3/stacker.yaml
     stacker publish -f ocibuilds/sub3/stacker.yaml --url oci:oci_publish --tag test1
     # Check the output does not contain the tag since no images should be published
     [[ ${output} =~ "will not publish: ocibuilds/sub3/stacker.yaml build_only layer3" ]]
 }
+
+@test "publish multi-arch index" {
+    cat > stacker.yaml <<EOF
+foo-amd64:
+    from:
+        type: docker
+        url: docker://centos:latest
+    platform: linux/amd64
+    publish:
+        name: foo
+foo-arm64:
+    from:
+        type: docker
+        url: docker://centos:latest
+    platform: linux/arm64/v8
+    publish:
+        name: foo
+EOF
+    stacker build
+    bad_stacker publish --url oci:oci_publish --tag test1
+    [[ "$output" =~ "foo-amd64 and foo-arm64 are both published as foo, use --multi-arch" ]]
+
+    stacker publish --url oci:oci_publish --tag test1 --multi-arch
+    index=$(cat oci_publish/index.json | jq -r '.manifests[] | select(.annotations."org.opencontainers.image.ref.name" == "foo_test1") | .digest' | cut -f2 -d:)
+    [ "$(cat oci_publish/blobs/sha256/$index | jq -r '.manifests | length')" == "2" ]
+    [ "$(cat oci_publish/blobs/sha256/$index | jq -r '.manifests[0].platform.architecture')" == "amd64" ]
+    [ "$(cat oci_publish/blobs/sha256/$index | jq -r '.manifests[1].platform.architecture')" == "arm64" ]
+    [ "$(cat oci_publish/blobs/sha256/$index | jq -r '.manifests[1].platform.variant')" == "v8" ]
+
+    amd64=$(cat oci_publish/blobs/sha256/$index | jq -r '.manifests[0].digest' | cut -f2 -d:)
+    arm64=$(cat oci_publish/blobs/sha256/$index | jq -r '.manifests[1].digest' | cut -f2 -d:)
+    config=$(cat oci_publish/blobs/sha256/$arm64 | jq -r '.config.digest' | cut -f2 -d:)
+    [ "$(cat oci_publish/blobs/sha256/$config | jq -r '.architecture')" == "arm64" ]
+
+    # foo-arm64 is built from centos's arm64 image, not the host's
+    [ "$(cat oci_publish/blobs/sha256/$amd64 | jq -r '.layers[0].digest')" != "$(cat oci_publish/blobs/sha256/$arm64 | jq -r '.layers[0].digest')" ]
+
+    # the temporary index tag doesn't stick around
+    [ -z "$(umoci ls --layout oci | grep stacker-publish-index)" ]
+}
@@ -0,0 +1,114 @@
+load helpers
+
+function setup() {
+    stacker_setup
+    cat > stacker.yaml <<EOF
+centos:
+    from:
+        type: docker
+        url: docker://centos:latest
+EOF
+}
+
+function teardown() {
+    cleanup
+}
+
+@test "pull never fails if the base isn't cached" {
+    bad_stacker build --pull never
+    [[ "$output" =~ "pull policy is never" ]]
+}
+
+@test "pull missing only copies the base once" {
+    stacker build --pull missing
+    [[ "$output" =~ "loading docker://centos:latest" ]]
+    stacker clean
+    stacker build --pull missing
+    [[ "$output" =~ "using cached copy of docker://centos:latest" ]]
+    [[ ! "$output" =~ "loading docker://centos:latest" ]]
+}
+
+@test "pull policy can be set per layer" {
+    cat > stacker.yaml <<EOF
+centos:
+    from:
+        type: docker
+        url: docker://centos:latest
+        pull: never
+EOF
+    bad_stacker build --pull always
+    [[ "$output" =~ "pull policy is never" ]]
+}
+
+@test "bad pull policies are rejected" {
+    bad_stacker build --pull sometimes
+    cat > stacker.yaml <<EOF
+centos:
+    from:
+        type: docker
+        url: docker://centos:latest
+        pull: sometimes
+EOF
+    bad_stacker build
+    [[ "$output" =~ "unknown pull policy sometimes" ]]
+}
+
+@test "prefetch warms the cache for builds and prerequisites" {
+    mkdir -p sub
+    cat > sub/stacker.yaml <<EOF
+ubuntu:
+    from:
+        type: docker
+        url: docker://ubuntu:latest
+EOF
+    cat > stacker.yaml <<EOF
+config:
+    prerequisites:
+        - sub/stacker.yaml
+centos:
+    from:
+        type: docker
+        url: docker://centos:latest
+    apply:
+        - docker://alpine:latest
+EOF
+    stacker prefetch --jobs 3
+    stacker recursive-build --pull never
+    umoci ls --layout .stacker/layer-bases/oci
+}
+
+@test "bases cached under their old names are pulled again" {
+    mkdir -p .stacker/layer-bases
+    skopeo --insecure-policy copy docker://centos:latest oci:.stacker/layer-bases/oci:centos
+
+    # "centos" could have been any registry's centos, so it isn't used
+    bad_stacker build --pull never
+    [[ "$output" =~ "not using docker://centos:latest cached by an older version of stacker as centos" ]]
+    [[ "$output" =~ "is not in the layer-bases cache and pull policy is never" ]]
+
+    stacker build --pull missing
+    [[ "$output" =~ "removing centos from the layer-bases cache" ]]
+    umoci ls --layout .stacker/layer-bases/oci
+    [ "$(umoci ls --layout .stacker/layer-bases/oci | grep -c .)" == "1" ]
+    umoci ls --layout .stacker/layer-bases/oci | grep -x "docker.io_library_centos_latest_[0-9a-f]*"
+}
+
+@test "pinned bases cached under their old names are migrated" {
+    d=$(skopeo inspect docker://centos:latest | jq -r .Digest)
+    cat > stacker.yaml <<EOF
+centos:
+    from:
+        type: docker
+        url: docker://centos:latest@$d
+EOF
+    mkdir -p .stacker/layer-bases
+    skopeo --insecure-policy copy docker://centos@$d oci:.stacker/layer-bases/oci:centos
+    # older versions of stacker recorded the digest it was copied from
+    jq ".manifests[0].annotations[\"com.cisco.stacker.source_digest\"] = \"$d\"" .stacker/layer-bases/oci/index.json > index.json
+    mv index.json .stacker/layer-bases/oci/index.json
+
+    stacker build --offline
+    [[ "$output" =~ "migrating docker://centos:latest@$d cached by an older version of stacker as centos" ]]
+    [ "$(umoci ls --layout .stacker/layer-bases/oci | grep -c .)" == "1" ]
+    [ -z "$(umoci ls --layout .stacker/layer-bases/oci | grep -x centos)" ]
+}
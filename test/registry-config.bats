@@ -0,0 +1,101 @@
+load helpers
+
+function setup() {
+    stacker_setup
+    cat > stacker.yaml <<EOF
+centos:
+    from:
+        type: docker
+        url: docker://centos:latest
+EOF
+}
+
+function teardown() {
+    cleanup
+}
+
+@test "registries_conf is used for pulls" {
+    cat > registries.conf <<EOF
+[[registry]]
+location = "docker.io"
+blocked = true
+EOF
+    cat > config.yaml <<EOF
+registries_conf: $(pwd)/registries.conf
+EOF
+    bad_stacker --config config.yaml build
+    [[ "$output" =~ "blocked" ]]
+}
+
+@test "auth_file and per registry settings are accepted" {
+    mkdir certs
+    echo '{"auths": {}}' > auth.json
+    cat > config.yaml <<EOF
+auth_file: $(pwd)/auth.json
+registries:
+    docker.io:
+        cert_dir: $(pwd)/certs
+EOF
+    stacker --config config.yaml build
+    umoci ls --layout oci
+}
+
+@test "unreachable mirrors fall back to the original reference" {
+    cat > config.yaml <<EOF
+mirrors:
+    docker.io:
+        - localhost:1/dockerhub
+EOF
+    stacker --config config.yaml build
+    echo "$output" | grep "couldn't pull docker://centos:latest from mirror"
+    umoci ls --layout oci
+    umoci ls --layout .stacker/layer-bases/oci | grep docker.io_library_centos_latest
+}
+
+@test "login and logout manage the auth file" {
+    echo -n pass | "${ROOT_DIR}/stacker" --offline --auth-file auth.json login --username user --password-stdin docker://reg.example.com
+    [ "$(jq -r '.auths."reg.example.com".auth' auth.json | base64 -d)" == "user:pass" ]
+    [ "$(stat -c %a auth.json)" == "600" ]
+
+    cat > config.yaml <<EOF
+auth_file: $(pwd)/auth.json
+EOF
+    echo -n pass2 | "${ROOT_DIR}/stacker" --offline --config config.yaml login --username user2 --password-stdin other.example.com
+    [ "$(jq -r '.auths."other.example.com".auth' auth.json | base64 -d)" == "user2:pass2" ]
+
+    stacker --config config.yaml logout reg.example.com
+    [ "$(jq -r '.auths."reg.example.com"' auth.json)" == "null" ]
+    bad_stacker --config config.yaml logout reg.example.com
+    [[ "$output" =~ "not logged in to reg.example.com" ]]
+
+    stacker --config config.yaml logout --all
+    [ "$(jq -r '.auths | length' auth.json)" == "0" ]
+}
+
+@test "publish credentials come from credential helpers" {
+    stacker build
+    mkdir bin
+    cat > bin/docker-credential-fake <<EOF
+#!/bin/sh
+echo "credential helper asked for \$(cat)" >&2
+exit 1
+EOF
+    chmod +x bin/docker-credential-fake
+    cat > config.yaml <<EOF
+registries:
+    localhost:1:
+        credential_helper: fake
+EOF
+    PATH="$(pwd)/bin:$PATH" bad_stacker --config config.yaml publish --url docker://localhost:1/ --tag test1 --retries 0
+    [[ "$output" =~ "docker-credential-fake couldn't get credentials for localhost:1" ]]
+    [[ "$output" =~ "credential helper asked for localhost:1" ]]
+
+    # --username and --password-stdin take precedence
+    run sh -c "echo pass | PATH=$(pwd)/bin:\$PATH ${ROOT_DIR}/stacker --config config.yaml publish --url docker://localhost:1/ --tag test1 --retries 0 --username user --password-stdin"
+    echo "$output"
+    [ "$status" -ne 0 ]
+    [[ ! "$output" =~ "credential helper asked" ]]
+
+    bad_stacker publish --url docker://localhost:1/ --tag test1 --password-stdin
+    [[ "$output" =~ "--password-stdin needs --username" ]]
+}
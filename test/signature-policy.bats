@@ -0,0 +1,68 @@
+load helpers
+
+function setup() {
+    stacker_setup
+    mkdir -p policy
+    skopeo --insecure-policy copy docker://centos:latest oci:policy/oci:centos
+    cat > stacker.yaml <<EOF
+centos:
+    from:
+        type: oci
+        url: policy/oci:centos
+EOF
+}
+
+function teardown() {
+    cleanup
+    rm -rf policy || true
+}
+
+@test "reject policies fail the build" {
+    echo '{"default": [{"type": "reject"}]}' > policy/reject.json
+    echo "signature_policy: $(pwd)/policy/reject.json" > policy/config.yaml
+    bad_stacker --config policy/config.yaml build
+    [[ "$output" =~ "oci:policy/oci:centos rejected by signature policy" ]]
+}
+
+@test "accepting policies work" {
+    cat > policy/accept.json <<EOF
+{
+    "default": [{"type": "reject"}],
+    "transports": {"oci": {"": [{"type": "insecureAcceptAnything"}]}}
+}
+EOF
+    echo "signature_policy: $(pwd)/policy/accept.json" > policy/config.yaml
+    stacker --config policy/config.yaml build
+}
+
+@test "signedBy requires signatures" {
+    export GNUPGHOME=$(pwd)/policy/gnupg
+    mkdir -m 700 -p $GNUPGHOME
+    gpg --batch --passphrase "" --quick-gen-key stacker-test@example.com
+    gpg --export stacker-test@example.com > policy/keyring.gpg
+    cat > policy/signed.json <<EOF
+{
+    "default": [{"type": "signedBy", "keyType": "GPGKeys", "keyPath": "$(pwd)/policy/keyring.gpg"}]
+}
+EOF
+    # per-base policies override the global one
+    cat > stacker.yaml <<EOF
+centos:
+    from:
+        type: oci
+        url: policy/oci:centos
+        signature_policy: $(pwd)/policy/signed.json
+EOF
+    bad_stacker build
+    [[ "$output" =~ "rejected by signature policy $(pwd)/policy/signed.json" ]]
+}
+
+@test "cached images are verified again when the policy changes" {
+    stacker build
+    echo '{"default": [{"type": "reject"}]}' > policy/reject.json
+    echo "signature_policy: $(pwd)/policy/reject.json" > policy/config.yaml
+    bad_stacker --config policy/config.yaml build --pull missing
+    [[ "$output" =~ "oci:policy/oci:centos rejected by signature policy" ]]
+    bad_stacker --config policy/config.yaml build --pull never
+    [[ "$output" =~ "not in the layer-bases cache" ]]
+}
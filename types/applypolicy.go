@@ -0,0 +1,159 @@
+package types
+
+import (
+	"path"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// These are the ways apply can resolve a conflict between a file in an
+// applied layer and the file that is already in the rootfs.
+const (
+	// ApplyMerge fails on metadata conflicts, and merges differing text
+	// files with a patch; it is the default.
+	ApplyMerge = "merge"
+	// ApplyFail fails on any conflict.
+	ApplyFail = "fail"
+	// ApplyUnionLines fails on metadata conflicts, and resolves differing
+	// text files by appending the applied file's lines that aren't already
+	// in the existing file.
+	ApplyUnionLines = "union-lines"
+	// ApplyPreferApplied replaces the existing file with the applied one.
+	ApplyPreferApplied = "prefer-applied"
+	// ApplyPreferBase keeps the existing file.
+	ApplyPreferBase = "prefer-base"
+
+	// applyPolicyDefault is the apply_policy key for the policy of paths
+	// that match nothing else.
+	applyPolicyDefault = "default"
+)
+
+func validApplyPolicy(policy string) bool {
+	switch policy {
+	case ApplyMerge, ApplyFail, ApplyUnionLines, ApplyPreferApplied, ApplyPreferBase:
+		return true
+	default:
+		return false
+	}
+}
+
+// applyPolicyRegexp converts an apply_policy path pattern to a regexp: *
+// and ? match within one path component, and ** matches any number of them.
+func applyPolicyRegexp(pattern string) (*regexp.Regexp, error) {
+	re := "^"
+	for i := 0; i < len(pattern); i++ {
+		switch pattern[i] {
+		case '*':
+			if i+1 < len(pattern) && pattern[i+1] == '*' {
+				re += ".*"
+				i++
+			} else {
+				re += "[^/]*"
+			}
+		case '?':
+			re += "[^/]"
+		default:
+			re += regexp.QuoteMeta(string(pattern[i]))
+		}
+	}
+
+	return regexp.Compile(re + "$")
+}
+
+// ValidateApplyPolicy checks that every entry in the layer's apply_policy is
+// a known policy with a valid path pattern.
+func (l *Layer) ValidateApplyPolicy() error {
+	for pattern, policy := range l.ApplyPolicy {
+		if !validApplyPolicy(policy) {
+			return errors.Errorf("unknown apply policy %s for %s", policy, pattern)
+		}
+
+		if pattern == applyPolicyDefault {
+			continue
+		}
+
+		if !path.IsAbs(pattern) {
+			return errors.Errorf("apply policy path %s must be absolute", pattern)
+		}
+
+		if _, err := applyPolicyRegexp(pattern); err != nil {
+			return errors.Wrapf(err, "bad apply policy path %s", pattern)
+		}
+	}
+
+	return nil
+}
+
+// ApplyPolicyFor returns the policy apply should use to resolve conflicts on
+// the file p (relative to the rootfs). An exact match wins; otherwise the
+// longest matching pattern does (the lexically first, if several are equally
+// long), and if nothing matches, the "default" entry or ApplyMerge is used.
+func (l *Layer) ApplyPolicyFor(p string) (string, error) {
+	p = path.Join("/", strings.TrimSuffix(p, "/"))
+
+	if policy, ok := l.ApplyPolicy[p]; ok {
+		return policy, nil
+	}
+
+	patterns := []string{}
+	for pattern := range l.ApplyPolicy {
+		if pattern != applyPolicyDefault {
+			patterns = append(patterns, pattern)
+		}
+	}
+
+	sort.Slice(patterns, func(i, j int) bool {
+		if len(patterns[i]) != len(patterns[j]) {
+			return len(patterns[i]) > len(patterns[j])
+		}
+		return patterns[i] < patterns[j]
+	})
+
+	for _, pattern := range patterns {
+		re, err := applyPolicyRegexp(pattern)
+		if err != nil {
+			return "", errors.Wrapf(err, "bad apply policy path %s", pattern)
+		}
+
+		if re.MatchString(p) {
+			return l.ApplyPolicy[pattern], nil
+		}
+	}
+
+	if policy, ok := l.ApplyPolicy[applyPolicyDefault]; ok {
+		return policy, nil
+	}
+
+	return ApplyMerge, nil
+}
+
+// These are the parts of the applied images' configs that apply_config can
+// merge into a layer's config.
+const (
+	// ApplyConfigNone ignores the applied images' configs; it is the
+	// default.
+	ApplyConfigNone = "none"
+	// ApplyConfigEnv merges the environment.
+	ApplyConfigEnv = "env"
+	// ApplyConfigLabels merges the labels.
+	ApplyConfigLabels = "labels"
+	// ApplyConfigAll merges the environment, labels, exposed ports,
+	// volumes, and entrypoint and cmd.
+	ApplyConfigAll = "all"
+)
+
+// ParseApplyConfig returns the layer's apply_config, or ApplyConfigNone if it
+// doesn't have one.
+func (l *Layer) ParseApplyConfig() (string, error) {
+	switch l.ApplyConfig {
+	case "":
+		return ApplyConfigNone, nil
+	case ApplyConfigNone, ApplyConfigEnv, ApplyConfigLabels, ApplyConfigAll:
+		return l.ApplyConfig, nil
+	default:
+		return "", errors.Errorf("unknown apply_config %s", l.ApplyConfig)
+	}
+}
@@ -2,6 +2,7 @@ package types
 
 import (
 	"fmt"
+	"strings"
 )
 
 // StackerConfig is a struct that contains global (or widely used) stacker
@@ -12,6 +13,45 @@ type StackerConfig struct {
 	RootFSDir   string `yaml:"rootfs_dir"`
 	Debug       bool   `yaml:"-"`
 	StorageType string `yaml:"-"`
+	Offline     bool   `yaml:"-"`
+
+	// AuthFile is the auth.json to look up registry credentials in,
+	// instead of containers/image's default locations.
+	AuthFile string `yaml:"auth_file"`
+
+	// RegistriesConf is the registries.conf to use, e.g. for mirrors.
+	RegistriesConf string `yaml:"registries_conf"`
+
+	// SignaturePolicy is a containers-policy.json(5) that docker, oci,
+	// and containers-storage bases and apply images must satisfy.
+	SignaturePolicy string `yaml:"signature_policy"`
+
+	// Mirrors maps a docker reference prefix (e.g. docker.io, or
+	// docker.io/library) to the prefixes of mirrors to try, in order,
+	// before falling back to the original reference.
+	Mirrors map[string][]string `yaml:"mirrors"`
+
+	// Registries holds per-registry settings, keyed by registry host
+	// (and port, if any).
+	Registries map[string]RegistryConfig `yaml:"registries"`
+}
+
+// RegistryConfig is the configuration for talking to a particular registry.
+type RegistryConfig struct {
+	// CertDir contains the CA certs (*.crt) and client certs (*.cert,
+	// *.key) to use with this registry.
+	CertDir string `yaml:"cert_dir"`
+
+	// Insecure skips TLS verification for this registry.
+	Insecure bool `yaml:"insecure"`
+
+	Username string `yaml:"username"`
+	Password string `yaml:"password"`
+
+	// CredentialHelper is the docker credential helper to get this
+	// registry's credentials from, i.e. docker-credential-<helper>, if
+	// Username isn't set.
+	CredentialHelper string `yaml:"credential_helper"`
 }
 
 // Substitutions - return an array of substitutions for StackerFiles
@@ -22,3 +62,15 @@ func (sc *StackerConfig) Substitutions() []string {
 		fmt.Sprintf("STACKER_OCI_DIR=%s", sc.OCIDir),
 	}
 }
+
+// NeedsNetworkError is returned when stacker is running with --offline and
+// some input is not available locally. Missing is the list of every input
+// that would have required network access, so that users can fix all of them
+// at once instead of one build at a time.
+type NeedsNetworkError struct {
+	Missing []string
+}
+
+func (e *NeedsNetworkError) Error() string {
+	return fmt.Sprintf("needs network, but running offline; missing:\n\t%s", strings.Join(e.Missing, "\n\t"))
+}
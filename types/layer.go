@@ -1,6 +1,7 @@
 package types
 
 import (
+	"fmt"
 	"os"
 	"path/filepath"
 	"reflect"
@@ -17,6 +18,13 @@ const (
 	OCILayer     = "oci"
 	BuiltLayer   = "built"
 	ScratchLayer = "scratch"
+	// DirLayer bases are a directory on the host to copy the rootfs from.
+	DirLayer = "dir"
+	// SquashfsLayer bases are a squashfs image of the rootfs.
+	SquashfsLayer = "squashfs"
+	// ContainersStorageLayer bases are images in the local
+	// containers/storage store (i.e. podman's or buildah's).
+	ContainersStorageLayer = "containers-storage"
 )
 
 type Layer struct {
@@ -36,6 +44,10 @@ type Layer struct {
 	BuildOnly          bool              `yaml:"build_only"`
 	Binds              interface{}       `yaml:"binds"`
 	Apply              []string          `yaml:"apply"`
+	ApplyPolicy        map[string]string `yaml:"apply_policy"`
+	ApplyConfig        string            `yaml:"apply_config"`
+	Platform           string            `yaml:"platform"`
+	Publish            *PublishConfig    `yaml:"publish" hash:"ignore"`
 	RuntimeUser        string            `yaml:"runtime_user"`
 	referenceDirectory string            // Location of the directory where the layer is defined
 }
@@ -116,23 +128,134 @@ func (l *Layer) ParseFullCommand() ([]string, error) {
 	})
 }
 
-func (l *Layer) ParseImport() ([]string, error) {
-	rawImports, err := l.getStringOrStringSlice(l.Import, func(s string) ([]string, error) {
-		return strings.Split(s, "\n"), nil
-	})
-	if err != nil {
-		return nil, err
+// Import is an entry in a layer's import list. Imports are usually just
+// paths or urls, but they may also be written as a map:
+//
+//	import:
+//	    - path: https://example.com/rootfs-extras.tar.xz
+//	      extract: true
+//
+// in which case Extract says whether or not the (possibly compressed) tar
+// archive at Path should be unpacked into the rootfs.
+type Import struct {
+	Path    string
+	Extract bool
+}
+
+// ParseApply returns the images in the layer's apply list.
+func (l *Layer) ParseApply() ([]*ImageSource, error) {
+	ret := []*ImageSource{}
+	for _, apply := range l.Apply {
+		is, err := NewImageSource(apply)
+		if err != nil {
+			return nil, err
+		}
+		is.Platform = l.Platform
+		ret = append(ret, is)
+	}
+
+	return ret, nil
+}
+
+func (l *Layer) ParseImports() ([]Import, error) {
+	if l.Import == nil {
+		return []Import{}, nil
+	}
+
+	var rawImports []interface{}
+	switch imports := l.Import.(type) {
+	case string:
+		for _, s := range strings.Split(imports, "\n") {
+			rawImports = append(rawImports, s)
+		}
+	case []string:
+		for _, s := range imports {
+			rawImports = append(rawImports, s)
+		}
+	case []interface{}:
+		rawImports = imports
+	default:
+		return nil, errors.Errorf("unknown import type: %T", l.Import)
 	}
 
-	var absImports []string
+	var imports []Import
 	for _, rawImport := range rawImports {
-		absImport, err := l.getAbsPath(rawImport)
+		var imp Import
+		switch i := rawImport.(type) {
+		case string:
+			imp.Path = i
+		case map[string]interface{}:
+			for k, v := range i {
+				switch k {
+				case "path":
+					p, ok := v.(string)
+					if !ok {
+						return nil, errors.Errorf("import path must be a string, got %T", v)
+					}
+					imp.Path = p
+				case "extract":
+					extract, ok := v.(bool)
+					if !ok {
+						return nil, errors.Errorf("import extract must be a bool, got %T", v)
+					}
+					imp.Extract = extract
+				default:
+					return nil, errors.Errorf("unknown import key %s", k)
+				}
+			}
+
+			if imp.Path == "" {
+				return nil, errors.Errorf("import is missing a path: %v", i)
+			}
+		default:
+			return nil, errors.Errorf("unknown import array type: %T", rawImport)
+		}
+
+		absImport, err := l.getAbsPath(imp.Path)
 		if err != nil {
 			return nil, err
 		}
-		absImports = append(absImports, absImport)
+		imp.Path = absImport
+
+		imports = append(imports, imp)
+	}
+
+	return imports, nil
+}
+
+// ParseImport returns the paths (or urls) of all of this layer's imports.
+func (l *Layer) ParseImport() ([]string, error) {
+	imports, err := l.ParseImports()
+	if err != nil {
+		return nil, err
+	}
+
+	var paths []string
+	for _, imp := range imports {
+		paths = append(paths, imp.Path)
+	}
+	return paths, nil
+}
+
+// jsonSafe converts the map[interface{}]interface{}s that yaml.v2 decodes
+// maps into to map[string]interface{}s, so that layers can be serialized as
+// json (e.g. in the build cache).
+func jsonSafe(v interface{}) interface{} {
+	switch t := v.(type) {
+	case map[interface{}]interface{}:
+		m := map[string]interface{}{}
+		for k, val := range t {
+			m[fmt.Sprintf("%v", k)] = jsonSafe(val)
+		}
+		return m
+	case []interface{}:
+		for i, val := range t {
+			t[i] = jsonSafe(val)
+		}
+		return t
+	default:
+		return v
 	}
-	return absImports, nil
 }
 
 func (l *Layer) ParseBinds() (map[string]string, error) {
@@ -181,6 +304,12 @@ func (l *Layer) ParseGenerateLabels() ([]string, error) {
 	})
 }
 
+// ParseDirBase returns the path of a dir base: its url, relative to the
+// directory the layer is defined in, just like imports.
+func (l *Layer) ParseDirBase() (string, error) {
+	return l.getAbsPath(l.From.Url)
+}
+
 func (l *Layer) getAbsPath(path string) (string, error) {
 	parsedPath, err := NewDockerishUrl(path)
 	if err != nil {
@@ -0,0 +1,80 @@
+package types
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/pkg/errors"
+	"gopkg.in/yaml.v2"
+)
+
+// Lockfile records the resolved versions of all of a stackerfile's network
+// inputs, so that builds on different machines (or at different times) use
+// exactly the same inputs.
+type Lockfile struct {
+	// Images maps the containers/image url of each docker/oci base and
+	// apply image to the digest of the manifest it resolved to.
+	Images map[string]string `yaml:"images"`
+
+	// Imports maps each http import (or tar base) to the sha256 of its
+	// content.
+	Imports map[string]string `yaml:"imports"`
+}
+
+func NewLockfile() *Lockfile {
+	return &Lockfile{
+		Images:  map[string]string{},
+		Imports: map[string]string{},
+	}
+}
+
+// ReadLockfile reads the lockfile at path. The bool result is false if there
+// is no lockfile there.
+func ReadLockfile(path string) (*Lockfile, bool, error) {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return NewLockfile(), false, nil
+		}
+		return nil, false, err
+	}
+
+	lock := NewLockfile()
+	if err := yaml.Unmarshal(content, lock); err != nil {
+		return nil, false, errors.Wrapf(err, "couldn't parse lockfile %s", path)
+	}
+
+	if lock.Images == nil {
+		lock.Images = map[string]string{}
+	}
+
+	if lock.Imports == nil {
+		lock.Imports = map[string]string{}
+	}
+
+	return lock, true, nil
+}
+
+func (l *Lockfile) Write(path string) error {
+	content, err := yaml.Marshal(l)
+	if err != nil {
+		return err
+	}
+
+	return ioutil.WriteFile(path, content, 0644)
+}
+
+// LockfilePath returns the path to the lockfile for this stackerfile, which
+// lives next to it and is named after it: stacker.yaml is locked in
+// stacker.lock, foo.yaml in foo.lock. Stackerfiles that were downloaded can't
+// be locked, so this returns "" for them.
+func (sf *Stackerfile) LockfilePath() string {
+	url, err := NewDockerishUrl(sf.path)
+	if err != nil || url.Scheme != "" {
+		return ""
+	}
+
+	return strings.TrimSuffix(sf.path, filepath.Ext(sf.path)) + ".lock"
+}
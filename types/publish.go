@@ -0,0 +1,123 @@
+package types
+
+import (
+	"bytes"
+	"fmt"
+	"runtime"
+	"strings"
+	"text/template"
+
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+)
+
+// PublishConfig is a layer's publish: block, which controls how stacker
+// publish publishes it.
+type PublishConfig struct {
+	// Name is a template for the image name to publish the layer as,
+	// instead of the layer's name (or --name-template). With stacker
+	// publish --multi-arch, layers that share a name (and have different
+	// platforms) are published as a single image index.
+	Name string `yaml:"name"`
+	// Tag is a template for the tags to publish the layer with, instead
+	// of the tags passed to stacker publish (or --tag-template). It is
+	// rendered once for each of those tags.
+	Tag string `yaml:"tag"`
+}
+
+// PublishTemplateData is what publish name templates can refer to.
+type PublishTemplateData struct {
+	// Layer is the layer's name.
+	Layer string
+	// Labels are the labels in the built image's config.
+	Labels map[string]string
+	// GitVersion is the git version of the stackerfile's directory.
+	GitVersion string
+	// Substitutions are the substitutions from --substitute and the
+	// config file.
+	Substitutions map[string]string
+}
+
+// PublishTagTemplateData is what publish tag templates can refer to.
+type PublishTagTemplateData struct {
+	PublishTemplateData
+	// Tag is the tag passed to stacker publish.
+	Tag string
+}
+
+// RenderPublishTemplate renders the publish name or tag template tmpl with
+// data. Referring to labels or substitutions that don't exist is an error.
+func RenderPublishTemplate(tmpl string, data interface{}) (string, error) {
+	t, err := template.New("publish").Option("missingkey=error").Parse(tmpl)
+	if err != nil {
+		return "", errors.Wrapf(err, "bad publish template %s", tmpl)
+	}
+
+	var buf bytes.Buffer
+	if err := t.Execute(&buf, data); err != nil {
+		return "", errors.Wrapf(err, "couldn't render publish template %s", tmpl)
+	}
+
+	if buf.Len() == 0 {
+		return "", errors.Errorf("publish template %s rendered to nothing", tmpl)
+	}
+
+	return buf.String(), nil
+}
+
+// ValidatePublish checks that the templates in the layer's publish: block
+// parse.
+func (l *Layer) ValidatePublish() error {
+	if l.Publish == nil {
+		return nil
+	}
+
+	for _, tmpl := range []string{l.Publish.Name, l.Publish.Tag} {
+		if _, err := template.New("publish").Parse(tmpl); err != nil {
+			return errors.Wrapf(err, "bad publish template %s", tmpl)
+		}
+	}
+
+	return nil
+}
+
+// ParsePlatform returns the platform the layer is built for: its platform:
+// (os/architecture[/variant]), or the host's platform if it doesn't have one.
+func (l *Layer) ParsePlatform() (ispec.Platform, error) {
+	return ParsePlatform(l.Platform)
+}
+
+// ParsePlatform parses an os/architecture[/variant] platform string, or
+// returns the host's platform if it is empty.
+func ParsePlatform(s string) (ispec.Platform, error) {
+	if s == "" {
+		return ispec.Platform{OS: runtime.GOOS, Architecture: runtime.GOARCH}, nil
+	}
+
+	parts := strings.Split(s, "/")
+	if len(parts) < 2 || len(parts) > 3 {
+		return ispec.Platform{}, errors.Errorf("bad platform %s, should be os/architecture[/variant]", s)
+	}
+
+	for _, part := range parts {
+		if part == "" {
+			return ispec.Platform{}, errors.Errorf("bad platform %s, should be os/architecture[/variant]", s)
+		}
+	}
+
+	platform := ispec.Platform{OS: parts[0], Architecture: parts[1]}
+	if len(parts) == 3 {
+		platform.Variant = parts[2]
+	}
+
+	return platform, nil
+}
+
+// PlatformString renders platform as os/architecture[/variant].
+func PlatformString(platform ispec.Platform) string {
+	s := fmt.Sprintf("%s/%s", platform.OS, platform.Architecture)
+	if platform.Variant != "" {
+		s += "/" + platform.Variant
+	}
+	return s
+}
@@ -6,11 +6,13 @@ import (
 	"io/ioutil"
 	"net/http"
 	"os"
+	"path"
 	"path/filepath"
 	"regexp"
 	"strings"
 
 	"github.com/anuvu/stacker/log"
+	"github.com/opencontainers/go-digest"
 	"github.com/pkg/errors"
 	"gopkg.in/yaml.v2"
 )
@@ -107,11 +109,60 @@ func substitute(content string, substitutions []string) (string, error) {
 	return content, nil
 }
 
+// fetchRemoteStackerfile downloads a stackerfile over http. Successful
+// downloads are kept in the stacker dir, so that later --offline runs can use
+// them.
+func fetchRemoteStackerfile(stackerfile string, config StackerConfig) ([]byte, error) {
+	cached := ""
+	if config.StackerDir != "" {
+		cached = path.Join(config.StackerDir, "stackerfiles", digest.FromString(stackerfile).Encoded())
+	}
+
+	if config.Offline {
+		if cached == "" {
+			return nil, &NeedsNetworkError{Missing: []string{stackerfile}}
+		}
+
+		raw, err := ioutil.ReadFile(cached)
+		if os.IsNotExist(err) {
+			return nil, &NeedsNetworkError{Missing: []string{stackerfile}}
+		}
+		return raw, err
+	}
+
+	resp, err := http.Get(stackerfile)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != 200 {
+		return nil, errors.Errorf("stackerfile: couldn't download %s: %s", stackerfile, resp.Status)
+	}
+
+	raw, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	if cached != "" {
+		if err := os.MkdirAll(path.Dir(cached), 0755); err != nil {
+			return nil, err
+		}
+
+		if err := ioutil.WriteFile(cached, raw, 0644); err != nil {
+			return nil, errors.Wrapf(err, "couldn't cache stackerfile %s", stackerfile)
+		}
+	}
+
+	return raw, nil
+}
+
 // NewStackerfile creates a new stackerfile from the given path. substitutions
 // is a list of KEY=VALUE pairs of things to substitute. Note that this is
 // explicitly not a map, because the substitutions are performed one at a time
 // in the order that they are given.
-func NewStackerfile(stackerfile string, substitutions []string) (*Stackerfile, error) {
+func NewStackerfile(stackerfile string, substitutions []string, config StackerConfig) (*Stackerfile, error) {
 	var err error
 
 	sf := Stackerfile{}
@@ -146,17 +197,7 @@ func NewStackerfile(stackerfile string, substitutions []string) (*Stackerfile, e
 		sf.ReferenceDirectory = filepath.Dir(sf.path)
 
 	} else {
-		resp, err := http.Get(stackerfile)
-		if err != nil {
-			return nil, err
-		}
-		defer resp.Body.Close()
-
-		if resp.StatusCode != 200 {
-			return nil, errors.Errorf("stackerfile: couldn't download %s: %s", stackerfile, resp.Status)
-		}
-
-		raw, err = ioutil.ReadAll(resp.Body)
+		raw, err = fetchRemoteStackerfile(stackerfile, config)
 		if err != nil {
 			return nil, err
 		}
@@ -259,10 +300,46 @@ func NewStackerfile(stackerfile string, substitutions []string) (*Stackerfile, e
 			if len(layer.From.Tag) == 0 {
 				return nil, errors.Errorf("%s: from tag cannot be empty for image type 'built'", name)
 			}
+		case DirLayer, SquashfsLayer:
+			if len(layer.From.Url) == 0 {
+				return nil, errors.Errorf("%s: from url cannot be empty for image type '%s'", name, layer.From.Type)
+			}
+		}
+
+		if layer.From.Pull != "" {
+			if err := ValidatePullPolicy(layer.From.Pull); err != nil {
+				return nil, errors.Wrapf(err, "%s", name)
+			}
 		}
 
 		// Set the directory with the location where the layer was defined
 		layer.referenceDirectory = sf.ReferenceDirectory
+
+		layer.Import = jsonSafe(layer.Import)
+		if _, err := layer.ParseImports(); err != nil {
+			return nil, errors.Wrapf(err, "%s", name)
+		}
+
+		if _, err := layer.ParseApply(); err != nil {
+			return nil, errors.Wrapf(err, "%s", name)
+		}
+
+		if err := layer.ValidateApplyPolicy(); err != nil {
+			return nil, errors.Wrapf(err, "%s", name)
+		}
+
+		if _, err := layer.ParseApplyConfig(); err != nil {
+			return nil, errors.Wrapf(err, "%s", name)
+		}
+
+		if _, err := layer.ParsePlatform(); err != nil {
+			return nil, errors.Wrapf(err, "%s", name)
+		}
+		layer.From.Platform = layer.Platform
+
+		if err := layer.ValidatePublish(); err != nil {
+			return nil, errors.Wrapf(err, "%s", name)
+		}
 	}
 
 	return &sf, err
@@ -318,8 +395,25 @@ func (s *Stackerfile) DependencyOrder() ([]string, error) {
 				}
 			}
 
+			// Likewise for layers applied from this build
+			applies, err := layer.ParseApply()
+			if err != nil {
+				return nil, err
+			}
+
+			for _, apply := range applies {
+				if apply.Type != BuiltLayer {
+					continue
+				}
+
+				if _, ok := processed[apply.Tag]; !ok {
+					allStackerImportsProcessed = false
+					break
+				}
+			}
+
 			if allStackerImportsProcessed && (layer.From.Type != BuiltLayer || baseTagProcessed) {
-				// None of the imports using stacker:// are referencing unprocessed layers,
+				// None of the imports using stacker:// or applies are referencing unprocessed layers,
 				// and in case the base layer is type build we have already processed it
 				ret = append(ret, name)
 				processed[name] = true
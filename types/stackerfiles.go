@@ -11,16 +11,27 @@ type StackerFiles map[string]*Stackerfile
 
 // NewStackerFiles reads multiple Stackerfiles from a list of paths and applies substitutions
 // It adds the Stackerfiles mentioned in the prerequisite paths to the results
-func NewStackerFiles(paths []string, substituteVars []string) (StackerFiles, error) {
+// When offline, a *NeedsNetworkError listing the stackerfiles that aren't
+// cached is returned along with the ones that could be read, so that the rest
+// of their inputs can be checked too.
+func NewStackerFiles(paths []string, substituteVars []string, config StackerConfig) (StackerFiles, error) {
 	sfm := make(map[string]*Stackerfile, len(paths))
 
+	// When offline, keep going past stackerfiles that aren't cached so we
+	// can report all of them at once.
+	needsNetwork := &NeedsNetworkError{}
+
 	// Iterate over list of paths to stackerfiles
 	for _, path := range paths {
 		log.Debugf("initializing stacker recipe: %s", path)
 
 		// Read this stackerfile
-		sf, err := NewStackerfile(path, substituteVars)
+		sf, err := NewStackerfile(path, substituteVars, config)
 		if err != nil {
+			if nne, ok := err.(*NeedsNetworkError); ok {
+				needsNetwork.Missing = append(needsNetwork.Missing, nne.Missing...)
+				continue
+			}
 			return nil, err
 		}
 
@@ -40,15 +51,23 @@ func NewStackerFiles(paths []string, substituteVars []string) (StackerFiles, err
 		}
 
 		// Need to also add stackerfile dependencies of this stackerfile to the map of stackerfiles
-		depStackerFiles, err := NewStackerFiles(prerequisites, substituteVars)
+		depStackerFiles, err := NewStackerFiles(prerequisites, substituteVars, config)
 		if err != nil {
-			return nil, err
+			nne, ok := err.(*NeedsNetworkError)
+			if !ok {
+				return nil, err
+			}
+			needsNetwork.Missing = append(needsNetwork.Missing, nne.Missing...)
 		}
 		for depPath, depStackerFile := range depStackerFiles {
 			sfm[depPath] = depStackerFile
 		}
 	}
 
+	if len(needsNetwork.Missing) > 0 {
+		return sfm, needsNetwork
+	}
+
 	return sfm, nil
 }
 
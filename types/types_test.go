@@ -4,6 +4,7 @@ import (
 	"io/ioutil"
 	"os"
 	"reflect"
+	"strings"
 	"testing"
 )
 
@@ -20,7 +21,7 @@ func parse(t *testing.T, content string) *Stackerfile {
 		t.Fatalf("couldn't write content: %s", err)
 	}
 
-	sf, err := NewStackerfile(tf.Name(), nil)
+	sf, err := NewStackerfile(tf.Name(), nil, StackerConfig{})
 	if err != nil {
 		t.Fatalf("failed to parse %s\n\n%s", content, err)
 	}
@@ -165,3 +166,382 @@ func TestContainerProxyPassThroughByDefault(t *testing.T) {
 			expected, result)
 	}
 }
+
+func TestParseTag(t *testing.T) {
+	// the readable part of each tag; the rest is a hash of the reference
+	cases := map[string]string{
+		"docker://centos:latest":                              "docker.io_library_centos_latest",
+		"docker://centos":                                     "docker.io_library_centos_latest",
+		"docker://docker.io/library/centos":                   "docker.io_library_centos_latest",
+		"docker://registry-a:5000/team/base:1":                "registry-a_5000_team_base_1",
+		"docker://registry-b.example.com/other/base:2":        "registry-b.example.com_other_base_2",
+		"docker://docker.io/team/base_1:latest":               "docker.io_team_base_1_latest",
+		"docker://docker.io/team/base:1_latest":               "docker.io_team_base_1_latest",
+		"oci:/some/layout:base":                               "oci__some_layout_base",
+		"oci:/some/../other/layout/:base":                     "oci__other_layout_base",
+		"oci:/some/layout/base:1":                             "oci__some_layout_base_1",
+		"oci:/some/layout:base_1":                             "oci__some_layout_base_1",
+		"docker://alpine@sha256:" + strings.Repeat("a", 64):   "docker.io_library_alpine_sha256_" + strings.Repeat("a", 64),
+		"docker://alpine:3@sha256:" + strings.Repeat("a", 64): "docker.io_library_alpine_3_sha256_" + strings.Repeat("a", 64),
+		"docker://example.com/" + strings.Repeat("a", 200):    "example.com_" + strings.Repeat("a", 99),
+	}
+
+	// the same image gets the same tag however it's spelled, and different
+	// images never share one
+	canonical := map[string]string{
+		"docker://centos":                   "docker://centos:latest",
+		"docker://docker.io/library/centos": "docker://centos:latest",
+		"oci:/some/../other/layout/:base":   "oci:/other/layout:base",
+	}
+
+	tags := map[string]string{}
+	for url, expected := range cases {
+		is, err := NewImageSource(url)
+		if err != nil {
+			t.Fatalf("couldn't parse %s: %s", url, err)
+		}
+
+		tag, err := is.ParseTag()
+		if err != nil {
+			t.Fatalf("couldn't get tag for %s: %s", url, err)
+		}
+
+		if len(tag) > maxTagLength {
+			t.Fatalf("tag for %s too long: %s", url, tag)
+		}
+
+		if !strings.HasPrefix(tag, expected+"_") || len(tag) != len(expected)+17 {
+			t.Fatalf("bad tag for %s, expected %s_<hash> got %s", url, expected, tag)
+		}
+
+		image := url
+		if c, ok := canonical[url]; ok {
+			image = c
+		}
+
+		if other, ok := tags[tag]; ok && other != image {
+			t.Fatalf("%s and %s have the same tag %s", image, other, tag)
+		}
+		tags[tag] = image
+	}
+
+	// the same image for another platform is a different image
+	arm64 := &ImageSource{Type: DockerLayer, Url: "docker://centos:latest", Platform: "linux/arm64/v8"}
+	arm64Tag, err := arm64.ParseTag()
+	if err != nil {
+		t.Fatalf("couldn't get tag for %s: %s", arm64.Url, err)
+	}
+
+	if other, ok := tags[arm64Tag]; ok {
+		t.Fatalf("%s for %s has the same tag %s as %s", arm64.Url, arm64.Platform, arm64Tag, other)
+	}
+
+	legacy, err := (&ImageSource{Type: DockerLayer, Url: "docker://registry-a/team/base:1"}).LegacyTag()
+	if err != nil {
+		t.Fatalf("couldn't get legacy tag: %s", err)
+	}
+
+	if legacy != "base" {
+		t.Fatalf("bad legacy tag %s", legacy)
+	}
+}
+
+func TestPinnedDigest(t *testing.T) {
+	d := "sha256:" + strings.Repeat("a", 64)
+
+	url, err := NewDockerishUrl("docker://alpine:3@" + d)
+	if err != nil {
+		t.Fatalf("couldn't parse url: %s", err)
+	}
+
+	if url.Host != "alpine:3" || url.Tag != "3" || url.Digest != d {
+		t.Fatalf("bad url %v", url)
+	}
+
+	is, err := NewImageSource("docker://alpine:3@" + d)
+	if err != nil {
+		t.Fatalf("couldn't parse image source: %s", err)
+	}
+
+	pinned, err := is.PinnedDigest()
+	if err != nil {
+		t.Fatalf("couldn't get pinned digest: %s", err)
+	}
+
+	if pinned.String() != d {
+		t.Fatalf("bad pinned digest %s", pinned)
+	}
+
+	pullURL, err := is.PullURL()
+	if err != nil {
+		t.Fatalf("couldn't get pull url: %s", err)
+	}
+
+	if pullURL != "docker://docker.io/library/alpine@"+d {
+		t.Fatalf("bad pull url %s", pullURL)
+	}
+
+	is, err = NewImageSource("docker://alpine:3")
+	if err != nil {
+		t.Fatalf("couldn't parse image source: %s", err)
+	}
+
+	pinned, err = is.PinnedDigest()
+	if err != nil || pinned != "" {
+		t.Fatalf("unpinned image had digest %s (%v)", pinned, err)
+	}
+}
+
+func TestParseImports(t *testing.T) {
+	content := `thing:
+    from:
+        type: docker
+        url: docker://centos:latest
+    import:
+        - /plain
+        - path: /archive.tar.xz
+          extract: true
+        - path: /not-extracted.tar
+`
+	sf := parse(t, content)
+	l, ok := sf.Get("thing")
+	if !ok {
+		t.Fatalf("missing thing layer")
+	}
+
+	imports, err := l.ParseImports()
+	if err != nil {
+		t.Fatalf("couldn't parse imports: %s", err)
+	}
+
+	expected := []Import{
+		{Path: "/plain"},
+		{Path: "/archive.tar.xz", Extract: true},
+		{Path: "/not-extracted.tar"},
+	}
+	if !reflect.DeepEqual(imports, expected) {
+		t.Fatalf("bad imports %v", imports)
+	}
+
+	paths, err := l.ParseImport()
+	if err != nil {
+		t.Fatalf("couldn't parse import paths: %s", err)
+	}
+
+	if !reflect.DeepEqual(paths, []string{"/plain", "/archive.tar.xz", "/not-extracted.tar"}) {
+		t.Fatalf("bad import paths %v", paths)
+	}
+}
+
+func TestMirrors(t *testing.T) {
+	mirrors := map[string][]string{
+		"docker.io":         {"mirror.local/dockerhub", "mirror2.local"},
+		"docker.io/library": {"library.local/"},
+		"quay.io":           {"quay.local"},
+	}
+
+	cases := map[string][]string{
+		"docker://alpine:3":                   {"docker://library.local/alpine:3"},
+		"docker://anuvu/stacker:latest":       {"docker://mirror.local/dockerhub/anuvu/stacker:latest", "docker://mirror2.local/anuvu/stacker:latest"},
+		"docker://quay.io/foo/bar:1":          {"docker://quay.local/foo/bar:1"},
+		"docker://registry.example.com/baz:1": nil,
+	}
+
+	for url, expected := range cases {
+		is, err := NewImageSource(url)
+		if err != nil {
+			t.Fatalf("couldn't parse %s: %s", url, err)
+		}
+
+		is.Insecure = true
+		result, err := is.Mirrors(mirrors)
+		if err != nil {
+			t.Fatalf("couldn't get mirrors for %s: %s", url, err)
+		}
+
+		if len(result) != len(expected) {
+			t.Fatalf("bad mirrors for %s: %v", url, result)
+		}
+
+		for i, m := range result {
+			if m.Url != expected[i] {
+				t.Fatalf("bad mirror for %s: %s (expected %s)", url, m.Url, expected[i])
+			}
+
+			if m.Insecure {
+				t.Fatalf("mirror %s inherited insecure", m.Url)
+			}
+		}
+
+		if is.Url != url {
+			t.Fatalf("original url modified: %s", is.Url)
+		}
+	}
+}
+
+func TestApplyPolicy(t *testing.T) {
+	l := &Layer{ApplyPolicy: map[string]string{
+		"/etc/passwd":       ApplyUnionLines,
+		"/usr/share/doc/**": ApplyPreferApplied,
+		"/usr/share/*/foo":  ApplyPreferBase,
+		"default":           ApplyFail,
+	}}
+
+	if err := l.ValidateApplyPolicy(); err != nil {
+		t.Fatalf("valid policy failed validation: %s", err)
+	}
+
+	cases := map[string]string{
+		"etc/passwd":                ApplyUnionLines,
+		"etc/group":                 ApplyFail,
+		"usr/share/doc/bash/":       ApplyPreferApplied,
+		"usr/share/doc/bash/README": ApplyPreferApplied,
+		"usr/share/man/foo":         ApplyPreferBase,
+		"usr/share/man/bar/foo":     ApplyFail,
+	}
+
+	for p, expected := range cases {
+		policy, err := l.ApplyPolicyFor(p)
+		if err != nil {
+			t.Fatalf("couldn't get policy for %s: %s", p, err)
+		}
+
+		if policy != expected {
+			t.Fatalf("bad policy for %s: %s (expected %s)", p, policy, expected)
+		}
+	}
+
+	// equally long patterns are tried in lexical order, not map order
+	l = &Layer{ApplyPolicy: map[string]string{
+		"/etc/*.conf": ApplyPreferBase,
+		"/etc/a.con*": ApplyPreferApplied,
+	}}
+	for i := 0; i < 20; i++ {
+		policy, err := l.ApplyPolicyFor("etc/a.conf")
+		if err != nil {
+			t.Fatalf("couldn't get policy for etc/a.conf: %s", err)
+		}
+
+		if policy != ApplyPreferBase {
+			t.Fatalf("bad policy for etc/a.conf: %s (expected %s)", policy, ApplyPreferBase)
+		}
+	}
+
+	policy, err := (&Layer{}).ApplyPolicyFor("etc/passwd")
+	if err != nil {
+		t.Fatalf("couldn't get default policy: %s", err)
+	}
+
+	if policy != ApplyMerge {
+		t.Fatalf("bad default policy %s", policy)
+	}
+
+	l = &Layer{ApplyPolicy: map[string]string{"/etc/passwd": "clobber"}}
+	if err := l.ValidateApplyPolicy(); err == nil {
+		t.Fatalf("unknown policy passed validation")
+	}
+
+	l = &Layer{ApplyPolicy: map[string]string{"etc/passwd": ApplyFail}}
+	if err := l.ValidateApplyPolicy(); err == nil {
+		t.Fatalf("relative path passed validation")
+	}
+}
+
+func TestApplyDependencyOrder(t *testing.T) {
+	content := `both:
+    from:
+        type: docker
+        url: docker://centos:latest
+    apply:
+        - stacker://a
+        - built:b
+a:
+    from:
+        type: docker
+        url: docker://centos:latest
+b:
+    from:
+        type: docker
+        url: docker://centos:latest
+`
+	sf := parse(t, content)
+	do, err := sf.DependencyOrder()
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+
+	if len(do) != 3 || do[2] != "both" {
+		t.Fatalf("bad do: %v", do)
+	}
+
+	l, _ := sf.Get("both")
+	applies, err := l.ParseApply()
+	if err != nil {
+		t.Fatalf("couldn't parse applies: %s", err)
+	}
+
+	for i, tag := range []string{"a", "b"} {
+		if applies[i].Type != BuiltLayer || applies[i].Tag != tag {
+			t.Fatalf("bad apply %d: %v", i, applies[i])
+		}
+	}
+
+	if _, err := NewImageSource("stacker://a/foo"); err == nil {
+		t.Fatalf("stacker:// apply with a path parsed")
+	}
+}
+
+func TestParsePlatform(t *testing.T) {
+	l := &Layer{Platform: "linux/arm64/v8"}
+	platform, err := l.ParsePlatform()
+	if err != nil {
+		t.Fatalf("couldn't parse platform: %s", err)
+	}
+
+	if platform.OS != "linux" || platform.Architecture != "arm64" || platform.Variant != "v8" {
+		t.Fatalf("bad platform %v", platform)
+	}
+
+	if PlatformString(platform) != l.Platform {
+		t.Fatalf("bad platform string %s", PlatformString(platform))
+	}
+
+	for _, bad := range []string{"linux", "linux/", "linux/arm/v7/extra"} {
+		l = &Layer{Platform: bad}
+		if _, err := l.ParsePlatform(); err == nil {
+			t.Fatalf("bad platform %s parsed", bad)
+		}
+	}
+}
+
+func TestRenderPublishTemplate(t *testing.T) {
+	data := PublishTagTemplateData{
+		PublishTemplateData: PublishTemplateData{
+			Layer:         "foo",
+			Labels:        map[string]string{"team": "core"},
+			GitVersion:    "v1.0-3-gabcdef",
+			Substitutions: map[string]string{"PREFIX": "prod"},
+		},
+		Tag: "latest",
+	}
+
+	result, err := RenderPublishTemplate("{{.Substitutions.PREFIX}}/{{.Labels.team}}/{{.Layer}}:{{.GitVersion}}-{{.Tag}}", data)
+	if err != nil {
+		t.Fatalf("couldn't render template: %s", err)
+	}
+
+	if result != "prod/core/foo:v1.0-3-gabcdef-latest" {
+		t.Fatalf("bad template result %s", result)
+	}
+
+	for _, bad := range []string{"{{.Labels.missing}}", "{{.Nope}}", "{{.Layer", "{{if false}}x{{end}}"} {
+		if _, err := RenderPublishTemplate(bad, data); err == nil {
+			t.Fatalf("bad template %s rendered", bad)
+		}
+	}
+
+	// name templates can't refer to the tag
+	if _, err := RenderPublishTemplate("{{.Tag}}", data.PublishTemplateData); err == nil {
+		t.Fatalf("name template used the tag")
+	}
+}